@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sessionCookie   = "session"
+	sessionLifetime = 12 * time.Hour
+
+	// failed logins allowed from an address, or for a username, within
+	// loginWindow before it is locked out for loginLockout
+	maxLoginFailures = 5
+	loginWindow      = 15 * time.Minute
+	loginLockout     = 15 * time.Minute
+)
+
+// errors shown on the login page
+var (
+	errBadLogin    = errors.New("wrong username or password")
+	errLockedLogin = errors.New("too many failed logins, try again later")
+)
+
+// Session is the signed-in user, carried in a signed cookie
+type Session struct {
+	ID         string // random, lets a logout revoke the cookie
+	User       string // User.ID
+	Generation int    // User.SessionGeneration when it started
+	Expires    time.Time
+}
+
+// starts a session for user
+func newSession(user User) Session {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		log.Fatal("session id: " + err.Error())
+	}
+
+	return Session{ID: hex.EncodeToString(id), User: user.ID, Generation: user.SessionGeneration, Expires: time.Now().Add(sessionLifetime)}
+}
+
+// sessionKey signs session cookies. Set sessionSecret to keep sessions valid
+// across restarts and instances, otherwise a random key is used.
+func sessionKey() []byte {
+	if secret := os.Getenv("sessionSecret"); secret != "" {
+		return []byte(secret)
+	}
+
+	log.Println("sessionSecret not set, admins are logged out on restart")
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatal("session key: " + err.Error())
+	}
+
+	return key
+}
+
+// cookie value of the session: payload.signature
+func (s *Server) encodeSession(session Session) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(session.ID + "|" + session.User + "|" + strconv.Itoa(session.Generation) + "|" + strconv.FormatInt(session.Expires.Unix(), 10)))
+
+	return payload + "." + s.sign(payload)
+}
+
+// parses and verifies a cookie value made by encodeSession
+func (s *Server) decodeSession(value string) (Session, error) {
+	parts := strings.SplitN(value, ".", 2)
+	if len(parts) != 2 || !hmac.Equal([]byte(s.sign(parts[0])), []byte(parts[1])) {
+		return Session{}, errors.New("bad session signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return Session{}, err
+	}
+
+	fields := strings.SplitN(string(payload), "|", 4)
+	if len(fields) != 4 {
+		return Session{}, errors.New("bad session payload")
+	}
+
+	generation, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return Session{}, err
+	}
+
+	expires, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return Session{}, err
+	}
+
+	session := Session{ID: fields[0], User: fields[1], Generation: generation, Expires: time.Unix(expires, 0)}
+	if time.Now().After(session.Expires) {
+		return Session{}, errors.New("session expired")
+	}
+
+	if s.revoked.has(session.ID) {
+		return Session{}, errors.New("session logged out")
+	}
+
+	return session, nil
+}
+
+func (s *Server) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.sessionKey)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// session of the request, if it has a valid one
+func (s *Server) requestSession(r *http.Request) (Session, bool) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return Session{}, false
+	}
+
+	session, err := s.decodeSession(cookie.Value)
+	if err != nil {
+		return Session{}, false
+	}
+
+	return session, true
+}
+
+type sessionContextKey struct{}
+
+// session of a request that went through requireSession
+func sessionFromContext(r *http.Request) Session {
+	session, _ := r.Context().Value(sessionContextKey{}).(Session)
+	return session
+}
+
+// lets only signed-in users through, everyone else is sent to the login page
+func (s *Server) requireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, ok := s.requestSession(r)
+		if !ok {
+			http.Redirect(w, r, loginURL(r), http.StatusSeeOther)
+			return
+		}
+
+		// the account may have been deleted since the login, or its
+		// password or role changed
+		user, err := s.store.GetUser(session.User)
+		if err != nil {
+			if err == ErrNotFound {
+				http.Redirect(w, r, loginURL(r), http.StatusSeeOther)
+				return
+			}
+
+			http.Error(w, "Finding user: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if session.Generation != user.SessionGeneration {
+			http.Redirect(w, r, loginURL(r), http.StatusSeeOther)
+			return
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), sessionContextKey{}, session))
+		next.ServeHTTP(w, withUser(r, user))
+	})
+}
+
+// login page that brings the user back to r afterwards
+func loginURL(r *http.Request) string {
+	return "/admin/login?next=" + url.QueryEscape(r.URL.RequestURI())
+}
+
+// next if it is an admin page of this site, "" otherwise. "/admin/" rules
+// out "//host" and "/\host", which browsers take for other sites.
+func localNext(next string) string {
+	if !strings.HasPrefix(next, "/admin/") || strings.ContainsAny(next, "\\\r\n") {
+		return ""
+	}
+	return next
+}
+
+// data of the login page
+type LoginPage struct {
+	Next     string // where to go after signing in
+	Username string
+	Message  string
+}
+
+// signs a user in
+func (s *Server) Login(w http.ResponseWriter, r *http.Request) {
+	if !ValidMethod(r) {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data := LoginPage{Next: localNext(r.FormValue("next")), Username: r.FormValue("username")}
+
+	if r.Method == http.MethodGet {
+		if session, ok := s.requestSession(r); ok {
+			if user, err := s.store.GetUser(session.User); err == nil && session.Generation == user.SessionGeneration {
+				if data.Next == "" {
+					data.Next = landingPage(user)
+				}
+
+				http.Redirect(w, r, data.Next, http.StatusSeeOther)
+				return
+			}
+		}
+
+		templates(r).ExecuteTemplate(w, "admin-login.html", data)
+		return
+	}
+
+	user, err := s.checkLogin(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		data.Message = err.Error()
+		templates(r).ExecuteTemplate(w, "admin-login.html", data)
+		return
+	}
+
+	// the password is right, the code comes next
+	if user.TOTPEnabled {
+		http.SetCookie(w, &http.Cookie{
+			Name:     totpCookie,
+			Value:    s.encodePendingLogin(user.ID),
+			Path:     "/admin/login",
+			MaxAge:   int(totpLoginTimeout.Seconds()),
+			HttpOnly: true,
+			Secure:   isHTTPS(r),
+			SameSite: http.SameSiteLaxMode,
+		})
+
+		target := "/admin/login/2fa"
+		if data.Next != "" {
+			target += "?next=" + url.QueryEscape(data.Next)
+		}
+
+		http.Redirect(w, r, target, http.StatusSeeOther)
+		return
+	}
+
+	if data.Next == "" {
+		data.Next = landingPage(user)
+	}
+
+	s.startSession(w, r, user)
+	http.Redirect(w, r, data.Next, http.StatusSeeOther)
+}
+
+// signs user in by setting the session cookie
+func (s *Server) startSession(w http.ResponseWriter, r *http.Request, user User) {
+	session := newSession(user)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    s.encodeSession(session),
+		Path:     "/",
+		Expires:  session.Expires,
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// signs the user out
+func (s *Server) Logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	session := sessionFromContext(r)
+	s.revoked.add(session.ID, session.Expires)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
+}
+
+// checks the login form against the user accounts, counting failures per
+// client address and per username so neither can be guessed at
+func (s *Server) checkLogin(r *http.Request) (User, error) {
+	addr := clientAddr(r)
+	name := "user:" + strings.ToLower(r.FormValue("username"))
+
+	if s.logins.locked(addr) || s.logins.locked(name) {
+		return User{}, errLockedLogin
+	}
+
+	user, err := s.authenticate(r.FormValue("username"), r.FormValue("password"))
+	if err == errBadLogin {
+		lockedAddr, lockedName := s.logins.fail(addr), s.logins.fail(name)
+		if lockedAddr || lockedName {
+			log.Println("Login locked for", addr, name)
+			return User{}, errLockedLogin
+		}
+		return User{}, errBadLogin
+	}
+
+	if err != nil {
+		return User{}, err
+	}
+
+	s.logins.succeed(addr)
+	s.logins.succeed(name)
+	return user, nil
+}
+
+// revokedSessions are sessions logged out before they expired. They are
+// kept in memory, a restart with a fixed sessionSecret forgets them.
+type revokedSessions struct {
+	mu  sync.Mutex
+	ids map[string]time.Time // session ID: expiry
+}
+
+func newRevokedSessions() *revokedSessions {
+	return &revokedSessions{ids: map[string]time.Time{}}
+}
+
+func (rs *revokedSessions) add(id string, expires time.Time) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	// expired sessions are rejected anyway
+	now := time.Now()
+	for old, exp := range rs.ids {
+		if now.After(exp) {
+			delete(rs.ids, old)
+		}
+	}
+
+	rs.ids[id] = expires
+}
+
+func (rs *revokedSessions) has(id string) bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	_, ok := rs.ids[id]
+	return ok
+}
+
+// loginLimiter counts failed logins per client address and username
+type loginLimiter struct {
+	mu       sync.Mutex
+	attempts map[string]*loginAttempts
+}
+
+type loginAttempts struct {
+	failures    int
+	first       time.Time // first failure of the current window
+	lockedUntil time.Time
+}
+
+func newLoginLimiter() *loginLimiter {
+	return &loginLimiter{attempts: map[string]*loginAttempts{}}
+}
+
+// reports if addr is locked out
+func (l *loginLimiter) locked(addr string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	a, ok := l.attempts[addr]
+	return ok && time.Now().Before(a.lockedUntil)
+}
+
+// records a failed login and reports if it locked addr out
+func (l *loginLimiter) fail(addr string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.forgetOld(now)
+
+	a, ok := l.attempts[addr]
+	if !ok {
+		a = &loginAttempts{first: now}
+		l.attempts[addr] = a
+	}
+
+	a.failures++
+	if a.failures >= maxLoginFailures {
+		a.lockedUntil = now.Add(loginLockout)
+		return true
+	}
+
+	return false
+}
+
+// clears the failures of addr after a successful login
+func (l *loginLimiter) succeed(addr string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.attempts, addr)
+}
+
+// drops addresses whose window and lockout are over, so the map does not
+// grow forever
+func (l *loginLimiter) forgetOld(now time.Time) {
+	for addr, a := range l.attempts {
+		if now.Sub(a.first) > loginWindow && now.After(a.lockedUntil) {
+			delete(l.attempts, addr)
+		}
+	}
+}
+
+// address of the client, the app runs behind the Heroku router which sets
+// X-Forwarded-For
+func clientAddr(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		addrs := strings.Split(forwarded, ",")
+		return strings.TrimSpace(addrs[len(addrs)-1])
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// reports if the client connected over https, directly or through the router
+func isHTTPS(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// runs a maintenance command given on the command line instead of the server,
+// e.g. "myblog migrate"
+func runCommand(store Store, args []string) error {
+	switch args[0] {
+	case "migrate":
+		applied, err := migrateStore(store)
+		if err != nil {
+			return errors.New("migrate: " + err.Error())
+		}
+		fmt.Printf("applied %d migration(s)\n", applied)
+		return nil
+	case "useradd":
+		if len(args) != 3 {
+			return errors.New("usage: myblog useradd <username> <" + strings.Join(roles, "|") + ">")
+		}
+		return addUser(store, args[1], args[2])
+	case "reset-2fa":
+		if len(args) != 2 {
+			return errors.New("usage: myblog reset-2fa <username>")
+		}
+		return resetTwoFactor(store, args[1])
+	default:
+		return errors.New("unknown command " + args[0])
+	}
+}
+
+// creates an account, the password is read from the first line of stdin so
+// it stays out of the shell history:
+//
+//	echo "$PASSWORD" | myblog useradd alice author
+func addUser(store Store, username, role string) error {
+	if _, err := migrateStore(store); err != nil {
+		return errors.New("migrate: " + err.Error())
+	}
+
+	if !usernameExp.MatchString(strings.ToLower(username)) {
+		return errors.New("usernames are 2 to 30 letters, digits, _ . or -")
+	}
+
+	if !Found(roles, role) {
+		return errors.New("unknown role " + role)
+	}
+
+	if _, err := store.GetUserByName(strings.ToLower(username)); err != ErrNotFound {
+		if err != nil {
+			return err
+		}
+		return errors.New("username " + username + " is taken")
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		return errors.New("reading password: " + err.Error())
+	}
+
+	user := newUser(username, role)
+	if err := user.setPassword(strings.TrimRight(password, "\r\n")); err != nil {
+		return err
+	}
+
+	if err := store.InsertUser(user); err != nil {
+		return err
+	}
+
+	fmt.Printf("created %s account %s\n", role, user.Username)
+	return nil
+}
+
+// turns two-factor authentication off for a user who lost their
+// authenticator app and recovery codes
+func resetTwoFactor(store Store, username string) error {
+	user, err := store.GetUserByName(strings.ToLower(username))
+	if err != nil {
+		if err == ErrNotFound {
+			return errors.New("no user " + username)
+		}
+		return err
+	}
+
+	user.resetTOTP()
+	if err := store.UpdateUser(user); err != nil {
+		return err
+	}
+
+	fmt.Printf("two-factor authentication of %s is off, they log in with their password alone\n", user.Username)
+	return nil
+}
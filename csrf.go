@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+	"html/template"
+	"log"
+	"net/http"
+)
+
+const (
+	csrfCookie = "csrf"
+	csrfField  = "csrf_token"
+	csrfHeader = "X-CSRF-Token"
+)
+
+// random ID of the visitor's browser session, kept in the csrf cookie. Forms
+// carry a token signed from it, which another site can neither read nor
+// forge.
+func newCSRFSession() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		log.Fatal("csrf session: " + err.Error())
+	}
+
+	return hex.EncodeToString(id)
+}
+
+// token forms of the csrf session must send back
+func (s *Server) csrfToken(csrfSession string) string {
+	return s.sign(csrfCookie + ":" + csrfSession)
+}
+
+type templatesContextKey struct{}
+
+// requestTemplates clones the templates for a request the first time it
+// renders one, most requests (assets, redirects) never do
+type requestTemplates struct {
+	server    *Server
+	csrfToken string
+	t         *template.Template
+}
+
+// templates of the request, with the csrf token of its visitor and the
+// spam filter fields of the comment forms
+func templates(r *http.Request) *template.Template {
+	rt, ok := r.Context().Value(templatesContextKey{}).(*requestTemplates)
+	if !ok {
+		// not served through csrfProtect, forms cannot be posted anyway
+		rt = &requestTemplates{}
+	}
+
+	if rt.t != nil {
+		return rt.t
+	}
+
+	// the base templates are never executed so they can be cloned
+	t, err := tpl.Clone()
+	if err != nil {
+		log.Fatal("cloning templates: " + err.Error())
+	}
+
+	token := rt.csrfToken
+	t.Funcs(template.FuncMap{
+		"csrfField": func() template.HTML {
+			return template.HTML(`<input type="hidden" name="` + csrfField + `" value="` + token + `">`)
+		},
+		"spamFields": func() template.HTML {
+			if rt.server == nil {
+				return ""
+			}
+			return rt.server.spamFields()
+		},
+	})
+
+	rt.t = t
+	return t
+}
+
+// gives every visitor a csrf session and rejects POSTs whose token does not
+// match it. Handlers render through templates(r), whose csrfField func
+// outputs the hidden token field of the visitor for the forms.
+func (s *Server) csrfProtect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		csrfSession := ""
+		if cookie, err := r.Cookie(csrfCookie); err == nil && len(cookie.Value) == 32 {
+			csrfSession = cookie.Value
+		}
+
+		// a request without the cookie cannot post a valid token either
+		if csrfSession == "" {
+			csrfSession = newCSRFSession()
+
+			http.SetCookie(w, &http.Cookie{
+				Name:     csrfCookie,
+				Value:    csrfSession,
+				Path:     "/",
+				HttpOnly: true,
+				Secure:   isHTTPS(r),
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+
+		token := s.csrfToken(csrfSession)
+		r = r.WithContext(context.WithValue(r.Context(), templatesContextKey{}, &requestTemplates{server: s, csrfToken: token}))
+
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodOptions && !isOneClickUnsubscribe(r) {
+			sent := r.Header.Get(csrfHeader)
+			if sent == "" {
+				sent = r.FormValue(csrfField)
+			}
+
+			if !hmac.Equal([]byte(sent), []byte(token)) {
+				log.Println("CSRF token mismatch:", r.Method, r.URL.Path, clientAddr(r))
+				w.WriteHeader(http.StatusForbidden)
+				templates(r).ExecuteTemplate(w, "csrf.html", nil)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	gomail "gopkg.in/gomail.v2"
+)
+
+// Message is a mail sent by the blog
+type Message struct {
+	To      []string          `bson:"to"`
+	Subject string            `bson:"subject"`
+	HTML    string            `bson:"html"`    // body
+	Headers map[string]string `bson:"headers"` // more headers, e.g. List-Unsubscribe
+}
+
+// Mailer delivers the mails of the blog
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// sender of the mails, from the mailFrom and mailFromName environment
+// variables
+type mailSender struct {
+	Address string
+	Name    string
+}
+
+// opens the mailer selected by the mailBackend environment variable, "log"
+// (default), "smtp" or "spool"
+func openMailer() (Mailer, error) {
+	from := mailSender{Address: os.Getenv("mailFrom"), Name: os.Getenv("mailFromName")}
+	if from.Name == "" {
+		from.Name = "Needrima"
+	}
+
+	switch backend := os.Getenv("mailBackend"); backend {
+	case "", "log":
+		return logMailer{}, nil
+	case "smtp":
+		return newSMTPMailer(from)
+	case "spool":
+		dir := os.Getenv("mailSpoolDir")
+		if dir == "" {
+			dir = "mail-spool"
+		}
+		return newSpoolMailer(dir, from)
+	default:
+		return nil, errors.New("unknown mail backend " + backend)
+	}
+}
+
+// builds the mail as it goes over the wire
+func (msg Message) compose(from mailSender) *gomail.Message {
+	mail := gomail.NewMessage()
+
+	mail.SetHeader("From", mail.FormatAddress(from.Address, from.Name))
+	mail.SetHeaders(map[string][]string{
+		"To":      msg.To,
+		"Subject": {msg.Subject},
+	})
+	for name, value := range msg.Headers {
+		mail.SetHeader(name, value)
+	}
+	mail.SetBody("text/html", msg.HTML)
+
+	return mail
+}
+
+// smtpMailer sends through an SMTP server, configured by the smtpHost,
+// smtpPort (default 587), smtpUsername and smtpPassword environment
+// variables. The certificate of the server is always verified: port 465
+// talks TLS from the start, other ports must upgrade with STARTTLS. A
+// server that does not offer it gets no mail, an attacker on the path
+// could have stripped it to read the mails, unless smtpPlaintext is true.
+type smtpMailer struct {
+	host      string
+	port      int
+	username  string
+	password  string
+	plaintext bool // send unencrypted when the server has no STARTTLS, for relays on the same machine
+	from      mailSender
+}
+
+func newSMTPMailer(from mailSender) (*smtpMailer, error) {
+	host := os.Getenv("smtpHost")
+	if host == "" {
+		return nil, errors.New("smtpHost is not set")
+	}
+
+	if from.Address == "" {
+		return nil, errors.New("mailFrom is not set")
+	}
+
+	port := 587
+	if p := os.Getenv("smtpPort"); p != "" {
+		var err error
+		if port, err = strconv.Atoi(p); err != nil {
+			return nil, errors.New("invalid smtpPort " + p)
+		}
+	}
+
+	return &smtpMailer{
+		host:      host,
+		port:      port,
+		username:  os.Getenv("smtpUsername"),
+		password:  os.Getenv("smtpPassword"),
+		plaintext: os.Getenv("smtpPlaintext") == "true",
+		from:      from,
+	}, nil
+}
+
+func (m *smtpMailer) Send(msg Message) error {
+	c, err := m.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err := gomail.Send(smtpSender{c}, msg.compose(m.from)); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+// connects to the server over TLS and signs in
+func (m *smtpMailer) dial() (*smtp.Client, error) {
+	addr := net.JoinHostPort(m.host, strconv.Itoa(m.port))
+	config := &tls.Config{ServerName: m.host}
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+
+	var conn net.Conn
+	var err error
+	if m.port == 465 {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, config)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if m.port != 465 {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(config); err != nil {
+				c.Close()
+				return nil, err
+			}
+		} else if !m.plaintext {
+			c.Close()
+			return nil, errors.New(m.host + " does not offer STARTTLS, not sending the mail unencrypted")
+		}
+	}
+
+	if m.username != "" {
+		if err := c.Auth(m.auth(c)); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// strongest mechanism the server offers to sign in with. PLAIN and LOGIN
+// refuse to send the password over an unencrypted connection.
+func (m *smtpMailer) auth(c *smtp.Client) smtp.Auth {
+	_, mechanisms := c.Extension("AUTH")
+
+	switch {
+	case strings.Contains(mechanisms, "CRAM-MD5"):
+		return smtp.CRAMMD5Auth(m.username, m.password)
+	case strings.Contains(mechanisms, "LOGIN") && !strings.Contains(mechanisms, "PLAIN"):
+		return loginAuth{username: m.username, password: m.password, host: m.host}
+	default:
+		return smtp.PlainAuth("", m.username, m.password, m.host)
+	}
+}
+
+// loginAuth is the LOGIN mechanism, the only one some servers offer
+type loginAuth struct {
+	username, password, host string
+}
+
+func (a loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && server.Name != "localhost" {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	default:
+		return nil, errors.New("unexpected server challenge " + string(fromServer))
+	}
+}
+
+// smtpSender hands a composed mail to a connected client
+type smtpSender struct {
+	c *smtp.Client
+}
+
+func (s smtpSender) Send(from string, to []string, msg io.WriterTo) error {
+	if err := s.c.Mail(from); err != nil {
+		return err
+	}
+
+	for _, addr := range to {
+		if err := s.c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+
+	w, err := s.c.Data()
+	if err != nil {
+		return err
+	}
+
+	if _, err := msg.WriteTo(w); err != nil {
+		w.Close()
+		return err
+	}
+
+	return w.Close()
+}
+
+// spoolMailer writes every mail to a .eml file in a directory instead of
+// sending it, for development and for handing mails to another program
+type spoolMailer struct {
+	dir  string
+	from mailSender
+}
+
+func newSpoolMailer(dir string, from mailSender) (*spoolMailer, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	if from.Address == "" {
+		from.Address = "blog@localhost"
+	}
+
+	return &spoolMailer{dir: dir, from: from}, nil
+}
+
+func (m *spoolMailer) Send(msg Message) error {
+	// written under a temporary name first so readers of the spool never
+	// see half a mail
+	tmp, err := os.CreateTemp(m.dir, ".mail-*")
+	if err != nil {
+		return err
+	}
+
+	if _, err := msg.compose(m.from).WriteTo(tmp); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(m.dir, spoolName()))
+}
+
+// names sort by the time the mails were written
+func spoolName() string {
+	random := make([]byte, 4)
+	rand.Read(random)
+
+	return time.Now().UTC().Format("20060102T150405.000000000") + "-" + hex.EncodeToString(random) + ".eml"
+}
+
+// logMailer only logs the mails, so nothing leaves the machine
+type logMailer struct{}
+
+func (logMailer) Send(msg Message) error {
+	log.Printf("Mail to %s: %s\n%s", strings.Join(msg.To, ", "), msg.Subject, msg.HTML)
+	return nil
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MailJob is a mail waiting in the outgoing queue, or its record once sent
+type MailJob struct {
+	DatabaseID  primitive.ObjectID `bson:"_id"`
+	ID          string             `bson:"id"`
+	Kind        string             `bson:"kind"` // what the mail is for, e.g. "welcome"
+	Message     Message            `bson:"message"`
+	Status      string             `bson:"status"`
+	Attempts    int                `bson:"attempts"`
+	LastError   string             `bson:"lasterror"`
+	NextAttempt time.Time          `bson:"nextattempt"` // of a queued job, or when the lease of a sending one runs out
+	Created     time.Time          `bson:"created"`
+	Sent        time.Time          `bson:"sent"`
+}
+
+// statuses of mail jobs
+const (
+	MailQueued  = "queued"  // waiting for its next attempt
+	MailSending = "sending" // claimed by a worker
+	MailSent    = "sent"
+	MailDead    = "dead" // gave up after mailMaxAttempts, an admin can retry it
+)
+
+var mailStatuses = []string{MailQueued, MailSending, MailSent, MailDead}
+
+const (
+	mailWorkers     = 4 // mails sent at the same time
+	mailMaxAttempts = 8
+	mailRetryDelay  = time.Minute      // after the first failed attempt, doubles after every other one
+	mailLease       = 10 * time.Minute // a job still sending after it was lost with its worker, e.g. in a crash
+	mailKeepSent    = 30 * 24 * time.Hour
+)
+
+// time between two mails, from the mailPerMinute environment variable
+// (default 60), so a new post mailed to every subscriber stays under the
+// sending limits of the mail server
+func mailPace() (time.Duration, error) {
+	perMinute := 60
+	if p := os.Getenv("mailPerMinute"); p != "" {
+		var err error
+		if perMinute, err = strconv.Atoi(p); err != nil || perMinute <= 0 {
+			return 0, errors.New("invalid mailPerMinute " + p)
+		}
+	}
+
+	return time.Minute / time.Duration(perMinute), nil
+}
+
+// queues a mail, the queue workers send it in the background
+func (s *Server) queueMail(kind string, msg Message) error {
+	database_ID := primitive.NewObjectID()
+	now := time.Now()
+
+	err := s.store.InsertMailJob(MailJob{
+		DatabaseID:  database_ID,
+		ID:          database_ID.Hex(),
+		Kind:        kind,
+		Message:     msg,
+		Status:      MailQueued,
+		NextAttempt: now,
+		Created:     now,
+	})
+	if err != nil {
+		return err
+	}
+
+	s.wakeMailQueue()
+	return nil
+}
+
+// makes the queue look for due mails now
+func (s *Server) wakeMailQueue() {
+	// unless it was woken already
+	select {
+	case s.mailWake <- struct{}{}:
+	default:
+	}
+}
+
+// sends the queued mails one every pace at most, checking for due ones
+// every interval and whenever a mail is queued. Runs until the process
+// exits.
+func (s *Server) runMailQueue(interval, pace time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	throttle := time.NewTicker(pace)
+	defer throttle.Stop()
+
+	var purged time.Time
+	for {
+		for s.deliverDueMail(time.Now(), throttle.C) > 0 {
+		}
+
+		if time.Since(purged) > time.Hour {
+			if _, err := s.store.PurgeSentMailJobs(time.Now().Add(-mailKeepSent)); err != nil {
+				log.Println("Purging sent mail:", err)
+			}
+			purged = time.Now()
+		}
+
+		select {
+		case <-ticker.C:
+		case <-s.mailWake:
+		}
+	}
+}
+
+// sends up to mailWorkers due mails at the same time, each waiting for a
+// tick of throttle, and returns how many it tried
+func (s *Server) deliverDueMail(now time.Time, throttle <-chan time.Time) int {
+	jobs, err := s.store.ClaimMailJobs(now, now.Add(mailLease), mailWorkers)
+	if err != nil {
+		log.Println("Claiming mail jobs:", err)
+		return 0
+	}
+
+	var wg sync.WaitGroup
+	for _, job := range jobs {
+		wg.Add(1)
+		go func(job MailJob) {
+			defer wg.Done()
+			<-throttle
+			s.deliverMail(job, time.Now())
+		}(job)
+	}
+	wg.Wait()
+
+	return len(jobs)
+}
+
+// makes one attempt at sending job at now and records how it went
+func (s *Server) deliverMail(job MailJob, now time.Time) {
+	job.Attempts++
+
+	if err := s.mailer.Send(job.Message); err != nil {
+		job.LastError = err.Error()
+
+		if job.Attempts >= mailMaxAttempts {
+			job.Status = MailDead
+			log.Println("Giving up on mail", job.ID, "after", job.Attempts, "attempts:", err)
+		} else {
+			job.Status = MailQueued
+			job.NextAttempt = now.Add(retryDelay(job.Attempts))
+		}
+	} else {
+		job.Status, job.LastError, job.Sent = MailSent, "", now
+	}
+
+	if err := s.store.UpdateMailJob(job); err != nil {
+		log.Println("Saving mail job", job.ID+":", err)
+	}
+}
+
+// wait after the given number of failed attempts
+func retryDelay(attempts int) time.Duration {
+	return mailRetryDelay << (attempts - 1)
+}
+
+// data of the mail queue page
+type AdminMailPage struct {
+	User     User
+	Status   string // listed
+	Statuses []string
+	Counts   map[string]int // jobs by status
+	Jobs     []MailJob
+	Message  string
+}
+
+// lists the mail jobs by status and retries the selected ones
+func (s *Server) AdminMail(w http.ResponseWriter, r *http.Request) {
+	if !ValidMethod(r) {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data := AdminMailPage{
+		User:     currentUser(r),
+		Status:   r.FormValue("status"),
+		Statuses: mailStatuses,
+	}
+
+	if !Found(mailStatuses, data.Status) {
+		data.Status = MailDead
+	}
+
+	if r.Method == http.MethodPost {
+		r.ParseForm()
+
+		retried, err := s.retryMail(r.Form["job"])
+		if err != nil {
+			http.Error(w, "Retrying: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		data.Message = strconv.Itoa(retried) + " queued again"
+	}
+
+	var err error
+	if data.Counts, err = s.store.CountMailJobs(); err != nil {
+		http.Error(w, "Counting mail: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if data.Jobs, err = s.store.GetMailJobs(data.Status, 100); err != nil {
+		http.Error(w, "Finding mail: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	templates(r).ExecuteTemplate(w, "admin-mail.html", data)
+}
+
+// queues the dead or queued jobs with the given IDs for an attempt right
+// away, with a fresh set of attempts
+func (s *Server) retryMail(jobIDs []string) (int, error) {
+	retried := 0
+	for _, ID := range jobIDs {
+		job, err := s.store.GetMailJob(ID)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return retried, err
+		}
+
+		if job.Status != MailDead && job.Status != MailQueued {
+			return retried, errors.New("mail " + ID + " is " + job.Status)
+		}
+
+		job.Status, job.Attempts, job.NextAttempt = MailQueued, 0, time.Now()
+		if err := s.store.UpdateMailJob(job); err != nil {
+			return retried, err
+		}
+		retried++
+	}
+
+	if retried > 0 {
+		s.wakeMailQueue()
+	}
+
+	return retried, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// stubMailer records the mails it is given and fails with err when set
+type stubMailer struct {
+	err  error
+	sent []Message
+}
+
+func (m *stubMailer) Send(msg Message) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+// fixed clock of the queue tests, whole seconds so every store keeps it exactly
+var mailClock = time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+// stores a job due at now and returns it
+func addTestMailJob(t *testing.T, store Store, now time.Time) MailJob {
+	t.Helper()
+
+	database_ID := primitive.NewObjectID()
+	job := MailJob{
+		DatabaseID:  database_ID,
+		ID:          database_ID.Hex(),
+		Kind:        "test",
+		Message:     Message{To: []string{"reader@example.com"}, Subject: "Hello", HTML: "<p>Hello</p>"},
+		Status:      MailQueued,
+		NextAttempt: now,
+		Created:     now,
+	}
+	if err := store.InsertMailJob(job); err != nil {
+		t.Fatal(err)
+	}
+
+	return job
+}
+
+// claims the due jobs at now, expecting want of them
+func claimMailJobs(t *testing.T, store Store, now time.Time, want int) []MailJob {
+	t.Helper()
+
+	jobs, err := store.ClaimMailJobs(now, now.Add(mailLease), mailWorkers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != want {
+		t.Fatalf("at %v: claimed %d jobs, want %d", now, len(jobs), want)
+	}
+
+	return jobs
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		delay    time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{mailMaxAttempts - 1, 64 * time.Minute},
+	}
+
+	for _, test := range tests {
+		if delay := retryDelay(test.attempts); delay != test.delay {
+			t.Errorf("after %d attempts: got %v, want %v", test.attempts, delay, test.delay)
+		}
+	}
+}
+
+func TestDeliverMailBackoff(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		mailer := &stubMailer{err: errors.New("connection refused")}
+		s := NewServer(store, mailer)
+
+		job := addTestMailJob(t, store, mailClock)
+		now := mailClock
+
+		for attempt := 1; attempt < mailMaxAttempts; attempt++ {
+			s.deliverMail(claimMailJobs(t, store, now, 1)[0], now)
+
+			stored, err := store.GetMailJob(job.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.Status != MailQueued || stored.Attempts != attempt || stored.LastError != "connection refused" {
+				t.Fatalf("after attempt %d: got %s, %d attempts, error %q", attempt, stored.Status, stored.Attempts, stored.LastError)
+			}
+
+			next := now.Add(retryDelay(attempt))
+			if !stored.NextAttempt.Equal(next) {
+				t.Fatalf("after attempt %d: next attempt at %v, want %v", attempt, stored.NextAttempt, next)
+			}
+
+			// not due before its delay is over
+			claimMailJobs(t, store, next.Add(-time.Second), 0)
+			now = next
+		}
+
+		// the last attempt gives up
+		s.deliverMail(claimMailJobs(t, store, now, 1)[0], now)
+
+		stored, err := store.GetMailJob(job.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Status != MailDead || stored.Attempts != mailMaxAttempts {
+			t.Fatalf("after the last attempt: got %s, %d attempts, want %s", stored.Status, stored.Attempts, MailDead)
+		}
+
+		claimMailJobs(t, store, now.Add(24*time.Hour), 0)
+	})
+}
+
+func TestDeliverMailSent(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		mailer := &stubMailer{}
+		s := NewServer(store, mailer)
+
+		job := addTestMailJob(t, store, mailClock)
+		s.deliverMail(claimMailJobs(t, store, mailClock, 1)[0], mailClock)
+
+		stored, err := store.GetMailJob(job.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Status != MailSent || stored.Attempts != 1 || !stored.Sent.Equal(mailClock) {
+			t.Fatalf("got %s, %d attempts, sent %v", stored.Status, stored.Attempts, stored.Sent)
+		}
+		if len(mailer.sent) != 1 || mailer.sent[0].Subject != "Hello" {
+			t.Fatalf("mailer got %+v", mailer.sent)
+		}
+
+		claimMailJobs(t, store, mailClock.Add(time.Hour), 0)
+	})
+}
+
+func TestReclaimExpiredLease(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		job := addTestMailJob(t, store, mailClock)
+
+		// the worker that claimed it is lost, e.g. in a crash
+		claimMailJobs(t, store, mailClock, 1)
+
+		stored, err := store.GetMailJob(job.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Status != MailSending {
+			t.Fatalf("claimed job is %s, want %s", stored.Status, MailSending)
+		}
+
+		// nobody else sends it while the lease runs
+		claimMailJobs(t, store, mailClock.Add(mailLease-time.Second), 0)
+
+		reclaimed := claimMailJobs(t, store, mailClock.Add(mailLease), 1)
+		if reclaimed[0].ID != job.ID {
+			t.Fatalf("reclaimed %s, want %s", reclaimed[0].ID, job.ID)
+		}
+	})
+}
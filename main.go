@@ -1,11 +1,10 @@
 package main
 
 import (
-	"context"
-	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html/template"
 	"io/ioutil"
 	"log"
 	"math"
@@ -16,60 +15,54 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
-	"text/template"
 	"time"
 
-	gomail "gopkg.in/gomail.v2"
-
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
-	"golang.org/x/crypto/bcrypt"
-	//"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
-//global variables
+// global variables
 var (
 	tpl *template.Template
 
-	ctx context.Context
-
-	blogPosts    *mongo.Collection
-	blogComments *mongo.Collection
-	blogReplies  *mongo.Collection
-	emails       *mongo.Collection
-
 	fm = template.FuncMap{
-		"rbc": ReduceBlogContent,
-		"inc": Inc,
-		"dec": Dec,
+		"rbc":      ReduceBlogContent,
+		"inc":      Inc,
+		"dec":      Dec,
+		"join":     strings.Join,
+		"markdown": renderMarkdown,
+		"thread":   newCommentThread,
+
+		// replaced per request by csrfProtect
+		"csrfField":  func() template.HTML { return "" },
+		"spamFields": func() template.HTML { return "" },
 	}
 )
 
-type Reply struct {
-	DatabaseID primitive.ObjectID `bson:"_id"`
-	BelongsTo  string             `bson:"belongsto"` // ID of owning comment
-	Replier    string             `bson:"commentor"`
-	Reply      string             `bson:"comment"`
-}
-
 type Comment struct {
-	DatabaseID primitive.ObjectID `bson:"_id"`
-	ID         string             `bson:"id"`
-	BelongsTo  string             `bson:"belongsto"` // ID of owning blog post
-	Commentor  string             `bson:"commentor"`
-	Comment    string             `bson:"comment"`
-	Replies    []Reply            `bson:"replies"`
+	DatabaseID  primitive.ObjectID `bson:"_id"`
+	ID          string             `bson:"id"`
+	BelongsTo   string             `bson:"belongsto"` // ID of owning blog post
+	ParentID    string             `bson:"parentid"`  // ID of the comment it replies to, empty if it starts a thread
+	Depth       int                `bson:"depth"`     // number of comments above it in its thread
+	Commentor   string             `bson:"commentor"`
+	Comment     string             `bson:"comment"`
+	Replies     []Comment          `bson:"-"`           // approved replies, filled in for readers
+	Status      string             `bson:"status"`      // moderation status, see CommentApproved
+	SpamReport  string             `bson:"spamreport"`  // why the spam filter held it back
+	Trained     string             `bson:"trained"`     // spam or ham, what the spam classifier learnt from it
+	ContentHash string             `bson:"contenthash"` // finds duplicates, see contentHash
+	Commenter   string             `bson:"commenter"`   // random key of the browser it came from, see commenterKey
 }
 
 type NewPost struct {
 	DatabaseID   primitive.ObjectID `bson:"_id"`
 	ID           string             `bson:"id"`
 	Title        string             `bson:"title"`
+	Slug         string             `bson:"slug"` // url path segment, /blog/{slug}
 	Published    time.Time          `bson:"published"`
 	ReadTime     float64            `bson:"readtime"`
 	Content      string             `bson:"content"`
+	Format       string             `bson:"format"` // markdown, or empty for posts written before it
 	ImageName    string             `bson:"imagename"`
 	BpTitle      string             `bson:"bptitle"` //bullet point title
 	BulletPoints []string           `bson:"bulletpoint"`
@@ -78,22 +71,87 @@ type NewPost struct {
 	QuoteAuthor  string             `bson:"quoteauthor"`
 	VideoPath    string             `bson:"videopath"` // Youtube video path
 	Comments     []Comment          `bson:"comments"`
+	Status       string             `bson:"status"` // draft, scheduled or published
+	Tags         []string           `bson:"tags"`
+	Category     string             `bson:"category"`
+	Author       string             `bson:"author"` // User.ID of the writer
+}
+
+// post statuses, posts stored before statuses existed have none and count
+// as published
+const (
+	PostDraft     = "draft"
+	PostScheduled = "scheduled" // goes live at Published
+	PostPublished = "published"
+)
+
+// reports if readers can see the post
+func (p NewPost) IsPublished() bool {
+	return p.Status == PostPublished || p.Status == ""
 }
 
 type BlogPost struct {
 	NewPost
 	NumComment    int
 	PublishedDate string
+	Byline        *User  // nil if the author account is gone
+	Notice        string // shown above the comments
 }
 
 type BlogPostAndPageNumber struct {
 	BlogPosts  []BlogPost
 	PageNumber int
+	Heading    string     // title of the listing, "Blog posts" if empty
+	ListPath   string     // tag and category listings page with ?page=, home uses /next/ and /previous/
+	Tags       []TagCount // tag cloud
+}
+
+// data of the new/edit post form
+type PostForm struct {
+	Action  string // url the form is posted to
+	Post    NewPost
+	Message string
+
+	// a post written before markdown, its content was converted for the form
+	Converted bool
 }
 
 type Subscriber struct {
 	DatabaseID primitive.ObjectID `bson:"_id"`
 	Mail       string             `bson:"mail"`
+	Status     string             `bson:"status"` // pending until the address is confirmed, see SubscriberActive
+	Created    time.Time          `bson:"created"`
+	Tags       []string           `bson:"tags"`  // only mail posts with one of these tags, all posts if empty
+	Token      string             `bson:"token"` // random, in the links of their mails, see newSubscriberToken
+}
+
+// Server holds the dependencies shared by the http handlers
+type Server struct {
+	store      Store
+	sessionKey []byte // signs admin session cookies
+	revoked    *revokedSessions
+	logins     *loginLimiter
+	classifier *spamClassifier // learns from moderators
+	spamChecks []SpamCheck     // run on new comments and replies
+	mailer     Mailer
+	mailWake   chan struct{}            // signals the mail queue that a mail was queued
+	emailCheck func(email string) error // rejects undeliverable subscriber addresses
+}
+
+func NewServer(store Store, mailer Mailer) *Server {
+	classifier := &spamClassifier{store: store}
+
+	return &Server{
+		store:      store,
+		sessionKey: sessionKey(),
+		revoked:    newRevokedSessions(),
+		logins:     newLoginLimiter(),
+		classifier: classifier,
+		spamChecks: defaultSpamChecks(classifier),
+		mailer:     mailer,
+		mailWake:   make(chan struct{}, 1),
+		emailCheck: checkIfEmailIsRegistered,
+	}
 }
 
 func init() {
@@ -102,30 +160,41 @@ func init() {
 
 func main() {
 	// database connection
-	atlasURI := os.Getenv("atlasURI")
-	// shellURI := "mongodb://localhost:27017"
-	clientOptions := options.Client().ApplyURI(atlasURI)
-
-	ctx = context.Background()
-
-	client, err := mongo.Connect(ctx, clientOptions)
+	store, err := openStore()
 	if err != nil {
 		log.Fatal("client" + err.Error())
 	}
-	defer client.Disconnect(ctx)
+	defer store.Close()
 
-	database := client.Database("student-devs-blog")
+	// maintenance commands, e.g. "myblog migrate"
+	if len(os.Args) > 1 {
+		if err := runCommand(store, os.Args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	blogPosts = database.Collection("blog-posts")
+	if _, err := migrateStore(store); err != nil {
+		log.Fatal("migrate: " + err.Error())
+	}
 
-	blogComments = database.Collection("blog-comments")
+	mailer, err := openMailer()
+	if err != nil {
+		log.Fatal("mailer: " + err.Error())
+	}
 
-	blogReplies = database.Collection("blog-replies")
+	server := NewServer(store, mailer)
 
-	emails = database.Collection("emails")
+	// publishes scheduled posts when their time comes
+	go server.runScheduler(time.Minute)
 
-	//routing and serving
-	routes()
+	pace, err := mailPace()
+	if err != nil {
+		log.Fatal("mailer: " + err.Error())
+	}
+
+	// sends queued mails, including those left over from the last run
+	go server.runMailQueue(30*time.Second, pace)
 
 	port := os.Getenv("PORT")
 
@@ -133,7 +202,8 @@ func main() {
 		port = "8080"
 	}
 
-	http.ListenAndServe(":"+port, nil)
+	//routing and serving
+	http.ListenAndServe(":"+port, server.routes())
 }
 
 // http handler functions
@@ -142,7 +212,7 @@ func Visit(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/home", http.StatusSeeOther)
 }
 
-func Home(w http.ResponseWriter, r *http.Request) {
+func (s *Server) Home(w http.ResponseWriter, r *http.Request) {
 	if !ValidMethod(r) {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -150,46 +220,20 @@ func Home(w http.ResponseWriter, r *http.Request) {
 
 	//get first eight posts from database
 	limit, skip := int64(8), int64(0)
-	findOptions := options.FindOptions{
-		Limit: &limit,
-		Skip:  &skip,
-		Sort:  bson.M{"published": -1},
-	}
-
-	cursor, err := blogPosts.Find(ctx, bson.M{}, &findOptions)
+	posts, err := s.store.GetPosts(PostFilter{PublishedOnly: true}, skip, limit)
 	if err != nil {
 		http.Error(w, "Find: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer cursor.Close(ctx)
 
-	blogPosts := getBlogPostsFromCursor(cursor)
+	blogPosts := s.getBlogPosts(posts)
 
 	data := BlogPostAndPageNumber{BlogPosts: blogPosts}
 
-	if r.Method == http.MethodGet {
-		tpl.ExecuteTemplate(w, "index.html", data)
-	} else if r.Method == http.MethodPost {
-		if err := regiterSubscriber(r); err != nil {
-			if err.Error() == "unregistered" {
-				http.Error(w, "Email not deliverable. Check that email is correct or try again later", http.StatusBadRequest)
-				return
-			}
-
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		dataAndSubscriptionSucess := struct {
-			BlogPostAndPageNumber
-			SubscriptionSucess string
-		}{data, "Subscription sucessful"}
-
-		tpl.ExecuteTemplate(w, "index.html", dataAndSubscriptionSucess)
-	}
+	s.renderIndex(w, r, data)
 }
 
-func Next(w http.ResponseWriter, r *http.Request) {
+func (s *Server) Next(w http.ResponseWriter, r *http.Request) {
 	if !ValidMethod(r) {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -197,57 +241,36 @@ func Next(w http.ResponseWriter, r *http.Request) {
 
 	pageNumber, _ := strconv.Atoi(r.URL.Path[len("/next/"):])
 
-	// gets next eight blogposts
-	limit, skip := int64(8), int64(8*pageNumber)
-	findOptions := options.FindOptions{
-		Limit: &limit,
-		Skip:  &skip,
-		Sort:  bson.M{"published": -1},
+	if pageNumber < 0 {
+		http.Redirect(w, r, "/home", http.StatusSeeOther)
+		return
 	}
 
-	cursor, err := blogPosts.Find(ctx, bson.M{}, &findOptions)
+	// gets next eight blogposts
+	limit, skip := int64(8), int64(8*pageNumber)
+	posts, err := s.store.GetPosts(PostFilter{PublishedOnly: true}, skip, limit)
 	if err != nil {
 		http.Error(w, "Find: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer cursor.Close(ctx)
 
-	blogPosts := getBlogPostsFromCursor(cursor)
+	blogPosts := s.getBlogPosts(posts)
 
 	// if there are no more blogPosts in database
 	if len(blogPosts) == 0 {
-		//tpl.ExecuteTemplate(w, "page-end.html", nil)
+		//templates(r).ExecuteTemplate(w, "page-end.html", nil)
 		pageNumber--
 		http.Redirect(w, r, "/previous/"+strconv.Itoa(pageNumber), http.StatusSeeOther)
 		return
 	}
 
-	data := BlogPostAndPageNumber{blogPosts, pageNumber}
-
-	if r.Method == http.MethodGet {
-		tpl.ExecuteTemplate(w, "index.html", data)
-	} else if r.Method == http.MethodPost {
-		if err := regiterSubscriber(r); err != nil {
-			if err.Error() == "unregistered" { // unregistered/unreachable email address
-				http.Error(w, "Email not deliverable. Check that email is correct or try again later", http.StatusBadRequest)
-				return
-			}
-
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	data := BlogPostAndPageNumber{BlogPosts: blogPosts, PageNumber: pageNumber}
 
-		dataAndSubscriptionSucess := struct {
-			BlogPostAndPageNumber
-			SubscriptionSucess string
-		}{data, "Subscription sucessful"}
-
-		tpl.ExecuteTemplate(w, "index.html", dataAndSubscriptionSucess)
-	}
+	s.renderIndex(w, r, data)
 }
 
 // gets previous eight posts
-func Previous(w http.ResponseWriter, r *http.Request) {
+func (s *Server) Previous(w http.ResponseWriter, r *http.Request) {
 	if !ValidMethod(r) {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -262,27 +285,28 @@ func Previous(w http.ResponseWriter, r *http.Request) {
 	}
 
 	limit, skip := int64(8), int64(8*pageNumber)
-	findOptions := options.FindOptions{
-		Limit: &limit,
-		Skip:  &skip,
-		Sort:  bson.M{"published": -1},
-	}
-
-	cursor, err := blogPosts.Find(ctx, bson.M{}, &findOptions)
+	posts, err := s.store.GetPosts(PostFilter{PublishedOnly: true}, skip, limit)
 	if err != nil {
 		http.Error(w, "Find: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer cursor.Close(ctx)
 
-	blogPosts := getBlogPostsFromCursor(cursor)
+	blogPosts := s.getBlogPosts(posts)
+
+	data := BlogPostAndPageNumber{BlogPosts: blogPosts, PageNumber: pageNumber}
+
+	s.renderIndex(w, r, data)
+}
 
-	data := BlogPostAndPageNumber{blogPosts, pageNumber}
+// renders a page of post cards with the tag cloud, a POST to it is a
+// subscription from the form on top of the page
+func (s *Server) renderIndex(w http.ResponseWriter, r *http.Request, data BlogPostAndPageNumber) {
+	data.Tags = s.tagCloud()
 
 	if r.Method == http.MethodGet {
-		tpl.ExecuteTemplate(w, "index.html", data)
+		templates(r).ExecuteTemplate(w, "index.html", data)
 	} else if r.Method == http.MethodPost {
-		if err := regiterSubscriber(r); err != nil {
+		if err := s.regiterSubscriber(r); err != nil {
 			if err.Error() == "unregistered" { // unregistered/unreachable email address
 				http.Error(w, "Email not deliverable. Check that email is correct or try again later", http.StatusBadRequest)
 				return
@@ -297,34 +321,59 @@ func Previous(w http.ResponseWriter, r *http.Request) {
 			SubscriptionSucess string
 		}{data, "Subscription sucessful"}
 
-		tpl.ExecuteTemplate(w, "index.html", dataAndSubscriptionSucess)
+		templates(r).ExecuteTemplate(w, "index.html", dataAndSubscriptionSucess)
 	}
 }
 
-func Blog(w http.ResponseWriter, r *http.Request) {
+func (s *Server) Blog(w http.ResponseWriter, r *http.Request) {
 	path := r.URL.Path
-	id := path[6:]
-	//fmt.Println(id)
+	slug := path[6:]
+	//fmt.Println(slug)
+
+	post, err := s.getSinglePostFromSlug(slug)
+	if err == ErrNotFound {
+		// links from before slugs existed use the post ID, and renamed
+		// posts keep their old slugs. Unpublished posts get the 404, their
+		// slug would give their title away.
+		if old, err := s.store.GetPost(slug); err == nil && old.Slug != "" && old.IsPublished() {
+			http.Redirect(w, r, "/blog/"+old.Slug, http.StatusMovedPermanently)
+			return
+		}
+		if renamed, err := s.store.GetPostByOldSlug(slug); err == nil && renamed.Slug != "" && renamed.IsPublished() {
+			http.Redirect(w, r, "/blog/"+renamed.Slug, http.StatusMovedPermanently)
+			return
+		}
+	}
+	if err != nil {
+		if err == ErrNotFound {
+			// a real 404, so search engines drop dead links
+			w.WriteHeader(http.StatusNotFound)
+			templates(r).ExecuteTemplate(w, "page-end.html", nil)
+			return
+		}
 
-	if r.Method == http.MethodGet { // render blogPosts
-		post, err := getSinglePostFromID(id)
-		if err != nil {
-			if err == mongo.ErrNoDocuments {
-				tpl.ExecuteTemplate(w, "page-end.html", nil)
-				return
-			}
+		http.Error(w, "Something went wrong: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-			http.Error(w, "Something went wrong: "+err.Error(), http.StatusInternalServerError)
-			return
+	// drafts and scheduled posts can only be previewed by the admin
+	if !post.IsPublished() {
+		w.WriteHeader(http.StatusNotFound)
+		templates(r).ExecuteTemplate(w, "page-end.html", nil)
+		return
+	}
+
+	if r.Method == http.MethodGet { // render blogPosts
+		if r.FormValue("comment") == CommentPending {
+			post.Notice = "Thank you, your comment will show once a moderator approves it"
 		}
 
-		tpl.ExecuteTemplate(w, "blog-post.html", post)
+		templates(r).ExecuteTemplate(w, "blog-post.html", post)
 	} else if r.Method == http.MethodPost { // user trying to comment
 		//get comment
-		comment, err := getNewComment(r, id)
+		comment, err := s.getNewComment(r, post.ID)
 		if err != nil {
-			if err.Error() == "You already made this reply" {
-				log.Println("You already made this reply")
+			if err == errDuplicateComment || err == errNoParent {
 				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
@@ -333,38 +382,68 @@ func Blog(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// store in database
-		_, err = blogComments.InsertOne(ctx, comment)
+		comment.Commenter = s.commenterKey(w, r)
+
+		comment.Status, comment.SpamReport, err = s.screenSubmission(r, comment)
 		if err != nil {
 			http.Error(w, "Something went wrong", http.StatusInternalServerError)
 			return
 		}
 
-		http.Redirect(w, r, path, http.StatusSeeOther)
+		// store in database
+		if err := s.store.InsertComment(comment); err != nil {
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+
+		// spam gets the same answer, bots learn nothing
+		if !comment.IsApproved() {
+			http.Redirect(w, r, path+"?comment=pending#comment-section", http.StatusSeeOther)
+			return
+		}
+
+		http.Redirect(w, r, path+"#comment-"+comment.ID, http.StatusSeeOther)
 	}
 }
 
-// handle replies to a comment
-func ReplyToComment(w http.ResponseWriter, r *http.Request) {
-	path := r.URL.Path
-	commentToReplyID := path[len("/reply/"):]
+// links to the reply page of before threads go to the comment, replies are
+// posted from the post page
+func (s *Server) ReplyToComment(w http.ResponseWriter, r *http.Request) {
+	comment, err := s.store.GetComment(r.URL.Path[len("/reply/"):])
+	if err == nil && !comment.IsApproved() {
+		err = ErrNotFound
+	}
+
+	var post NewPost
+	if err == nil {
+		post, err = s.store.GetPost(comment.BelongsTo)
+	}
 
-	var comment Comment
+	if err != nil {
+		if err == ErrNotFound {
+			templates(r).ExecuteTemplate(w, "page-end.html", nil)
+			return
+		}
 
-	if err := blogComments.FindOne(ctx, bson.M{"id": commentToReplyID}).Decode(&comment); err != nil {
-		log.Println("Reply error: ", err)
-		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		http.Error(w, "Something went wrong: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/blog/"+post.Slug+"#comment-"+comment.ID, http.StatusMovedPermanently)
+}
+
+func (s *Server) About(w http.ResponseWriter, r *http.Request) {
+	if !ValidMethod(r) {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
 	if r.Method == http.MethodGet {
-		tpl.ExecuteTemplate(w, "reply.html", comment)
+		templates(r).ExecuteTemplate(w, "about.html", nil)
 	} else if r.Method == http.MethodPost {
-		reply, err := getNewReply(r, commentToReplyID)
-		if err != nil {
-			if err.Error() == "You already made this reply" {
-				log.Println("You already made this reply")
-				http.Error(w, err.Error(), http.StatusBadRequest)
+		if err := s.regiterSubscriber(r); err != nil {
+			if err.Error() == "unregistered" { // unregistered/unreachable email address
+				http.Error(w, "Email not deliverable. Check that email is correct or try again later", http.StatusBadRequest)
 				return
 			}
 
@@ -372,73 +451,280 @@ func ReplyToComment(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		_, err = blogReplies.InsertOne(ctx, reply)
+		templates(r).ExecuteTemplate(w, "about.html", "Sucess")
+	}
+}
+
+func (s *Server) NewBlog(w http.ResponseWriter, r *http.Request) {
+	//check for get and post
+	if !ValidMethod(r) {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		templates(r).ExecuteTemplate(w, "new-post.html", PostForm{Action: "/admin/new"})
+	} else if r.Method == http.MethodPost {
+		//get for data
+		post, err := getNewPost(r)
 		if err != nil {
-			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			http.Error(w, "Error: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		var owningPost NewPost
-		if err := blogPosts.FindOne(ctx, bson.M{"id": comment.BelongsTo}).Decode(&owningPost); err != nil {
-			log.Println("Getting owning blogpost error", err)
-			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		if err := s.assignSlug(&post); err != nil {
+			http.Error(w, "Slug: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		//store in database
+		if err := s.store.InsertPost(post); err != nil {
+			http.Error(w, "Inserting post: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		http.Redirect(w, r, "/blog/"+owningPost.ID, http.StatusSeeOther)
+		s.saveRevision(r, post, "created")
+
+		// drafts and scheduled posts are mailed when they go live
+		if post.Status == PostPublished {
+			s.notifySubscribers(post)
+		}
+
+		templates(r).ExecuteTemplate(w, "new-post.html", PostForm{Action: "/admin/new", Message: "Post added"})
 	}
+
 }
 
-func About(w http.ResponseWriter, r *http.Request) {
+// data of the admin post list
+type AdminPostsPage struct {
+	User    User
+	Posts   []NewPost
+	Authors map[string]string // User.ID: display name
+}
+
+// lists the posts the signed-in user may edit
+func (s *Server) AdminPosts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := currentUser(r)
+
+	filter := PostFilter{}
+	if !user.Can(PermAllPosts) {
+		filter.Author = user.ID
+	}
+
+	posts, err := s.store.GetPosts(filter, 0, 0)
+	if err != nil {
+		http.Error(w, "Find: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	users, err := s.store.GetUsers()
+	if err != nil {
+		http.Error(w, "Finding users: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	authors := map[string]string{}
+	for _, u := range users {
+		authors[u.ID] = u.DisplayName()
+	}
+
+	templates(r).ExecuteTemplate(w, "admin-posts.html", AdminPostsPage{User: user, Posts: posts, Authors: authors})
+}
+
+// edit an existing post
+func (s *Server) EditBlog(w http.ResponseWriter, r *http.Request) {
 	if !ValidMethod(r) {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
+	path := r.URL.Path
+	id := path[len("/admin/edit/"):]
+
+	post, err := s.store.GetPost(id)
+	if err != nil {
+		if err == ErrNotFound {
+			templates(r).ExecuteTemplate(w, "page-end.html", nil)
+			return
+		}
+
+		http.Error(w, "Something went wrong: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !currentUser(r).CanEditPost(post) {
+		forbidden(w)
+		return
+	}
+
 	if r.Method == http.MethodGet {
-		tpl.ExecuteTemplate(w, "about.html", nil)
+		form := PostForm{Action: path, Post: post}
+
+		// saving stores it as markdown
+		if post.Format == FormatLegacy {
+			form.Post.Content = legacyMarkdown(post)
+			form.Converted = true
+		}
+
+		templates(r).ExecuteTemplate(w, "new-post.html", form)
 	} else if r.Method == http.MethodPost {
-		if err := regiterSubscriber(r); err != nil {
-			if err.Error() == "unregistered" { // unregistered/unreachable email address
-				http.Error(w, "Email not deliverable. Check that email is correct or try again later", http.StatusBadRequest)
-				return
-			}
+		edited, err := getEditedPost(r, post)
+		if err != nil {
+			http.Error(w, "Error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
 
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if err := s.assignSlug(&edited); err != nil {
+			http.Error(w, "Slug: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		tpl.ExecuteTemplate(w, "about.html", "Sucess")
+		s.keepOriginal(post)
+
+		if err := s.store.UpdatePost(edited); err != nil {
+			http.Error(w, "Updating post: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if err := s.keepOldSlug(post, edited); err != nil {
+			log.Println("Keeping old slug:", err)
+		}
+
+		// a draft or scheduled post published by hand
+		if !post.IsPublished() && edited.IsPublished() {
+			s.notifySubscribers(edited)
+		}
+
+		// a replaced image is kept, older revisions still use it
+		s.saveRevision(r, edited, "edited")
+
+		templates(r).ExecuteTemplate(w, "new-post.html", PostForm{Action: path, Post: edited, Message: "Post updated"})
 	}
 }
 
-func NewBlog(w http.ResponseWriter, r *http.Request) {
-	//check for get and post
+// lets the admin see a post whatever its status
+func (s *Server) PreviewBlog(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := r.URL.Path[len("/admin/preview/"):]
+
+	post, err := s.getSinglePostFromID(id)
+	if err != nil {
+		if err == ErrNotFound {
+			templates(r).ExecuteTemplate(w, "page-end.html", nil)
+			return
+		}
+
+		http.Error(w, "Something went wrong: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !currentUser(r).CanEditPost(post.NewPost) {
+		forbidden(w)
+		return
+	}
+
+	templates(r).ExecuteTemplate(w, "blog-post.html", post)
+}
+
+// delete a post together with its comments, replies and image
+func (s *Server) DeleteBlog(w http.ResponseWriter, r *http.Request) {
 	if !ValidMethod(r) {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	if r.Method == http.MethodGet {
-		tpl.ExecuteTemplate(w, "new-post.html", nil)
+	path := r.URL.Path
+	id := path[len("/admin/delete/"):]
+
+	post, err := s.store.GetPost(id)
+	if err != nil {
+		if err == ErrNotFound {
+			templates(r).ExecuteTemplate(w, "page-end.html", nil)
+			return
+		}
+
+		http.Error(w, "Something went wrong: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !currentUser(r).CanEditPost(post) {
+		forbidden(w)
+		return
+	}
+
+	if r.Method == http.MethodGet { // confirmation step
+		// count what is going to be removed, whatever its moderation status
+		comments, err := s.store.GetComments(id)
+		if err != nil {
+			http.Error(w, "Finding comments: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		replies := 0
+		for _, comment := range comments {
+			if comment.ParentID != "" {
+				replies++
+			}
+		}
+
+		revisions, err := s.store.GetRevisions(id)
+		if err != nil {
+			http.Error(w, "Finding revisions: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		templates(r).ExecuteTemplate(w, "admin-delete.html", DeletedPost{Post: post, Comments: len(comments) - replies, Replies: replies, Revisions: len(revisions)})
 	} else if r.Method == http.MethodPost {
-		//get for data
-		post, err := getNewPost(r)
+		// images of all revisions, not just the current one
+		images := []string{}
+		if post.ImageName != "" {
+			images = append(images, post.ImageName)
+		}
+
+		revisions, err := s.store.GetRevisions(id)
 		if err != nil {
-			http.Error(w, "Error: "+err.Error(), http.StatusInternalServerError)
+			http.Error(w, "Finding revisions: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		//store in database
-		_, err = blogPosts.InsertOne(ctx, post)
+		for _, rev := range revisions {
+			if rev.ImageName != "" && !Found(images, rev.ImageName) {
+				images = append(images, rev.ImageName)
+			}
+		}
+
+		deleted, err := s.store.DeletePost(id)
 		if err != nil {
-			http.Error(w, "Inserting post: "+err.Error(), http.StatusInternalServerError)
+			if err == ErrNotFound {
+				templates(r).ExecuteTemplate(w, "page-end.html", nil)
+				return
+			}
+
+			http.Error(w, "Deleting post: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		tpl.ExecuteTemplate(w, "new-post.html", "Post added")
-	}
+		deleted.Done = true
 
+		for _, image := range images {
+			if err := os.Remove(filepath.Join("assets/images/blog", image)); err != nil {
+				log.Println("Removing image:", err)
+				continue // not removed, don't report it
+			}
+			deleted.Images = append(deleted.Images, image)
+		}
+
+		templates(r).ExecuteTemplate(w, "admin-delete.html", deleted)
+	}
 }
 
 // serve Favicon
@@ -448,22 +734,49 @@ func ServeFavicon(w http.ResponseWriter, r *http.Request) {
 
 //helping functions
 
-func routes() {
-	//handlers
-	http.HandleFunc("/", Visit)
-	http.HandleFunc("/home", Home)
-	http.HandleFunc("/next/", Next)
-	http.HandleFunc("/previous/", Previous)
-	http.HandleFunc("/blog/", Blog)
-	http.HandleFunc("/reply/", ReplyToComment)
-	http.HandleFunc("/about", About)
-	http.HandleFunc("/admin/new", NewBlog)
-	http.HandleFunc("/favicon.ico/", ServeFavicon)
+func (s *Server) routes() http.Handler {
+	mux := http.NewServeMux()
 
-	http.Handle("/assets/", http.StripPrefix("/assets/", http.FileServer(http.Dir("./assets"))))
+	//handlers
+	mux.HandleFunc("/", Visit)
+	mux.HandleFunc("/home", s.Home)
+	mux.HandleFunc("/next/", s.Next)
+	mux.HandleFunc("/previous/", s.Previous)
+	mux.HandleFunc("/blog/", s.Blog)
+	mux.HandleFunc("/tag/", s.TagPosts)
+	mux.HandleFunc("/category/", s.CategoryPosts)
+	mux.HandleFunc("/reply/", s.ReplyToComment)
+	mux.HandleFunc("/subscribe/confirm", s.ConfirmSubscription)
+	mux.HandleFunc("/subscription/", s.Subscription)
+	mux.HandleFunc("/about", s.About)
+	mux.HandleFunc("/favicon.ico/", ServeFavicon)
+
+	// admin pages, all but login need a session
+	admin := http.NewServeMux()
+	admin.HandleFunc("/admin/new", s.allow(PermWritePosts, s.NewBlog))
+	admin.HandleFunc("/admin/posts", s.allow(PermWritePosts, s.AdminPosts))
+	admin.HandleFunc("/admin/edit/", s.allow(PermWritePosts, s.EditBlog))
+	admin.HandleFunc("/admin/delete/", s.allow(PermWritePosts, s.DeleteBlog))
+	admin.HandleFunc("/admin/preview/", s.allow(PermWritePosts, s.PreviewBlog))
+	admin.HandleFunc("/admin/revisions/", s.allow(PermWritePosts, s.PostRevisions))
+	admin.HandleFunc("/admin/comments", s.allow(PermComments, s.AdminComments))
+	admin.HandleFunc("/admin/settings", s.allow(PermSettings, s.AdminSettings))
+	admin.HandleFunc("/admin/mail", s.allow(PermSettings, s.AdminMail))
+	admin.HandleFunc("/admin/users", s.allow(PermUsers, s.AdminUsers))
+	admin.HandleFunc("/admin/users/", s.AdminUser) // owners, or a user's own profile
+	admin.HandleFunc("/admin/2fa", s.TwoFactor)
+	admin.HandleFunc("/admin/logout", s.Logout)
+
+	mux.HandleFunc("/admin/login", s.Login)
+	mux.HandleFunc("/admin/login/2fa", s.LoginCode)
+	mux.Handle("/admin/", s.requireSession(admin))
+
+	mux.Handle("/assets/", http.StripPrefix("/assets/", http.FileServer(http.Dir("./assets"))))
+
+	return s.csrfProtect(mux)
 }
 
-//checks if method is get or post
+// checks if method is get or post
 func ValidMethod(r *http.Request) bool {
 	if r.Method != http.MethodGet && r.Method != http.MethodPost {
 		return false
@@ -471,12 +784,12 @@ func ValidMethod(r *http.Request) bool {
 	return true
 }
 
-//validate form inputs
+// validate form inputs
 func valid(input, exp string) bool {
 	return regexp.MustCompile(exp).MatchString(input)
 }
 
-//processe form and gets new post
+// processe form and gets new post
 func getNewPost(r *http.Request) (post NewPost, err error) {
 	// database information
 	database_ID := primitive.NewObjectID()
@@ -487,89 +800,147 @@ func getNewPost(r *http.Request) (post NewPost, err error) {
 
 	comments := []Comment{}
 
-	// get and validate form input
-	title, exp := r.FormValue("title"), `.*`
-	if !valid(title, exp) {
-		return NewPost{}, errors.New("invalid character in blog title")
-	}
-
-	content, exp := r.FormValue("content"), `.*`
-	if !valid(content, exp) {
-		log.Println()
-		return NewPost{}, errors.New("invalid character in content")
-	}
+	post = NewPost{DatabaseID: database_ID, ID: ID, Published: pub_Time, Comments: comments, Status: PostDraft, Author: currentUser(r).ID}
 
-	bp_heading, exp := r.FormValue("bullet-point-Heading"), `^[\sa-zA-Z0-9\.,\?/\\]{0,}$`
-	if !valid(bp_heading, exp) {
-		return NewPost{}, errors.New("invalid character in bullet point heading")
+	// get and validate form input
+	if err := readPostForm(r, &post); err != nil {
+		return NewPost{}, err
 	}
 
-	bullet_point_content, exp := r.FormValue("bullet-points-content"), `.*`
-	if !valid(bullet_point_content, exp) {
-		return NewPost{}, errors.New("invalid character in bullet points content")
+	if err := readPublishForm(r, &post); err != nil {
+		return NewPost{}, err
 	}
-	bullet_points := strings.Split(bullet_point_content, "/")
 
-	bq_heading, exp := r.FormValue("blog-quote-Heading"), `^[\sa-zA-Z0-9\.,\?/\\]{0,}$`
-	if !valid(bq_heading, exp) {
-		return NewPost{}, errors.New("invalid character in blog quote heading")
+	// process image file
+	file, img_header, err := r.FormFile("blogImage")
+	if err != nil {
+		return NewPost{}, err
 	}
+	ext := filepath.Ext(img_header.Filename)
 
-	blog_quote, exp := r.FormValue("blog-quote"), `.*`
-	if !valid(blog_quote, exp) {
-		return NewPost{}, errors.New("invalid character in blog quote content")
+	post.ImageName, err = uploadImageAndReturnName(file, ext, ID)
+	if err != nil {
+		return NewPost{}, err
 	}
 
-	quote_author, exp := r.FormValue("quote-author"), `.*`
-	if !valid(quote_author, exp) {
-		return NewPost{}, errors.New("invalid character in blog quote author")
-	}
+	// return new post data
+	return post, nil
+}
 
-	video_path, exp := r.FormValue("youtube-VideoPath"), `^[\sa-zA-Z0-9_]{0,}$`
-	if !valid(video_path, exp) {
-		return NewPost{}, errors.New("invalid character in youtube video path")
-	}
+// processes the edit form and returns the updated post. ID, published date
+// and comments of the existing post are kept, the image is only replaced if
+// a new one was uploaded.
+func getEditedPost(r *http.Request, existing NewPost) (NewPost, error) {
+	post := existing
 
-	admin_password, exp := r.FormValue("adminPassword"), `.*`
-	if !valid(admin_password, exp) {
-		return NewPost{}, errors.New("invalid character in admin password")
+	// get and validate form input
+	if err := readPostForm(r, &post); err != nil {
+		return NewPost{}, err
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(os.Getenv("adminPassword")), []byte(admin_password)); err != nil {
-		return NewPost{}, errors.New("invalid admin password: " + err.Error())
+	if err := readPublishForm(r, &post); err != nil {
+		return NewPost{}, err
 	}
 
-	// process image file
+	// process image file, optional when editing
 	file, img_header, err := r.FormFile("blogImage")
+	if err == http.ErrMissingFile {
+		return post, nil
+	}
 	if err != nil {
 		return NewPost{}, err
 	}
 	ext := filepath.Ext(img_header.Filename)
 
-	img_Name, err := uploadImageAndReturnName(file, ext, ID)
+	post.ImageName, err = uploadImageAndReturnName(file, ext, post.ID)
 	if err != nil {
 		return NewPost{}, err
 	}
 
-	read_Time := math.Round(float64(len(title)+len(content)+len(bp_heading)+len(bullet_point_content)+len(blog_quote)+len(quote_author)) / 100)
+	return post, nil
+}
+
+// minutes it takes to read a post, roughly
+func readTime(title, content string) float64 {
+	return math.Round(float64(len(title)+len(content)) / 100)
+}
 
-	// get subscribers email address
-	subscribers, err := getAllSubscribers()
+// validates the fields of the new/edit post form and sets them on post
+func readPostForm(r *http.Request, post *NewPost) error {
+	title, exp := r.FormValue("title"), `.*`
+	if !valid(title, exp) {
+		return errors.New("invalid character in blog title")
+	}
 
-	if err != nil { // delete image file and return error message
-		fmt.Println(err)
+	// markdown, lists and quotes are written in it too
+	content, exp := r.FormValue("content"), `.*`
+	if !valid(content, exp) {
+		log.Println()
+		return errors.New("invalid character in content")
 	}
 
-	// send mail to subscibers
-	if err := sendMailOnNewBlogPost(subscribers, ID, title); err != nil {
-		fmt.Println(err)
+	video_path, exp := r.FormValue("youtube-VideoPath"), `^[\sa-zA-Z0-9_]{0,}$`
+	if !valid(video_path, exp) {
+		return errors.New("invalid character in youtube video path")
 	}
 
-	// return new post data
-	return NewPost{database_ID, ID, title, pub_Time, read_Time, content, img_Name, bp_heading, bullet_points, bq_heading, blog_quote, quote_author, video_path, comments}, nil
+	// left empty it is made from the title
+	slug := slugify(r.FormValue("slug"))
+
+	tags := parseTags(r.FormValue("tags"))
+	category := slugify(r.FormValue("category"))
+
+	post.Title = title
+	post.Slug = slug
+	post.Tags = tags
+	post.Category = category
+	post.Content = content
+	post.Format = FormatMarkdown
+	post.VideoPath = video_path
+	post.ReadTime = readTime(title, content)
+
+	// part of the markdown content now
+	post.BpTitle = ""
+	post.BulletPoints = nil
+	post.BqTitle = ""
+	post.BlogQuote = ""
+	post.QuoteAuthor = ""
+
+	return nil
+}
+
+// sets the status and publish date of post from the form. Publishing a
+// post that was not live yet moves its publish date to now.
+func readPublishForm(r *http.Request, post *NewPost) error {
+	wasPublished := post.IsPublished()
+
+	switch status := r.FormValue("status"); status {
+	case "", PostPublished:
+		if !wasPublished {
+			post.Published = time.Now()
+		}
+		post.Status = PostPublished
+	case PostDraft:
+		post.Status = PostDraft
+	case PostScheduled:
+		publishAt, err := time.ParseInLocation("2006-01-02T15:04", r.FormValue("publish-at"), time.Local)
+		if err != nil {
+			return errors.New("invalid publish time")
+		}
+
+		if !publishAt.After(time.Now()) {
+			return errors.New("scheduled publish time must be in the future")
+		}
+
+		post.Status, post.Published = PostScheduled, publishAt
+	default:
+		return errors.New("invalid post status")
+	}
+
+	return nil
 }
 
-//checks if a string exists in a slice of strings
+// checks if a string exists in a slice of strings
 func Found(items []string, item string) bool {
 	for _, v := range items {
 		if v == item {
@@ -579,7 +950,7 @@ func Found(items []string, item string) bool {
 	return false
 }
 
-//processes image, store in images folder and retrieve its name
+// processes image, store in images folder and retrieve its name
 func uploadImageAndReturnName(file multipart.File, ext, ID string) (name string, err error) {
 	//check for correct file type
 	allowedExt := []string{".jpeg", ".jpg", ".png"}
@@ -600,124 +971,130 @@ func uploadImageAndReturnName(file multipart.File, ext, ID string) (name string,
 	defer f.Close()
 	f.Write(bs)
 
-	// get image name from blog directory
-	files, err := ioutil.ReadDir("assets/images/blog")
-	if err != nil {
-		return "", errors.New("reading images directory: " + err.Error())
-	}
-
-	var img_Name string
-	for _, v := range files {
-		if strings.Contains(v.Name(), ID) {
-			img_Name = v.Name()
-		}
-	}
-
-	return img_Name, nil
-}
-
-// checks if user is already subscribed
-func alreadySubcribed(email string) bool {
-	singleResult := emails.FindOne(ctx, bson.M{"mail": email})
-	return singleResult.Err() == nil
+	// a post can own several images over time (edits), so use the name of
+	// the file just created rather than searching the directory for the ID
+	return filepath.Base(f.Name()), nil
 }
 
 // register subscriber
-func regiterSubscriber(r *http.Request) error {
+func (s *Server) regiterSubscriber(r *http.Request) error {
 	//valide email
-	Email, exp := template.HTMLEscaper(r.FormValue("semail1")), `^([a-zA-z0-9.!#$%&'*+/=?^_{|}~-]{3,})@([a-zA-Z0-9]{2,})\.([a-zA-Z]{2,})(.[a-zA-Z]+)?$`
+	Email, exp := r.FormValue("semail1"), `^([a-zA-z0-9.!#$%&'*+/=?^_{|}~-]{3,})@([a-zA-Z0-9]{2,})\.([a-zA-Z]{2,})(.[a-zA-Z]+)?$`
 	fmt.Println("Email from subscriber:", Email)
 	if !valid(Email, exp) {
 		return errors.New("invalid email address")
 	}
 
 	// check if email is registered / reachable using "mailboxlayer api"
-	if err := checkIfEmailIsRegistered(Email); err != nil {
+	if err := s.emailCheck(Email); err != nil {
 		return err
 	}
 
 	//check if user is already subscribed
-	if alreadySubcribed(Email) {
-		return errors.New("you are already a subscriber")
+	existing, err := s.store.GetSubscriberByMail(Email)
+	if err != nil && err != ErrNotFound {
+		log.Println("Checking subscriber:", err)
+		return errors.New("an error occured")
 	}
 
-	// send welcome message
-	if err := sendWelcomeMail(Email); err != nil {
-		return err
+	if err == nil {
+		if existing.IsActive() {
+			return errors.New("you are already a subscriber")
+		}
+
+		// asked again before confirming, a new confirmation mail replaces
+		// the old one
+		if err := s.store.DeleteSubscriber(existing.DatabaseID.Hex()); err != nil && err != ErrNotFound {
+			log.Println("Replacing pending subscriber:", err)
+			return errors.New("an error occured")
+		}
 	}
 
-	// register new subscriber
-	newSubscriber := Subscriber{primitive.NewObjectID(), Email}
+	// register new subscriber, they get mails once they confirm the address
+	newSubscriber := Subscriber{DatabaseID: primitive.NewObjectID(), Mail: Email, Status: SubscriberPending, Created: time.Now(), Token: newSubscriberToken()}
 
-	if _, err := emails.InsertOne(ctx, newSubscriber); err != nil {
+	if err := s.store.InsertSubscriber(newSubscriber); err != nil {
 		log.Println("Error storing email to database")
 		return errors.New("an error occured")
 	}
 
+	if err := s.sendConfirmMail(newSubscriber); err != nil {
+		log.Println(err)
+		return errors.New("an error occured")
+	}
+
 	return nil
 }
 
-// get post comment from post id
-func getPostComments(ID string) []Comment {
-	var comments []Comment
-
-	cursor, err := blogComments.Find(ctx, bson.M{"belongsto": ID})
+// get the approved comments of a post from post id, each with its replies
+func (s *Server) getPostComments(ID string) []Comment {
+	comments, err := s.store.GetComments(ID)
 	if err != nil {
 		log.Println("Finding comments: " + err.Error())
 	}
-	defer cursor.Close(ctx)
 
-	for cursor.Next(ctx) {
-		var comment Comment
+	return commentThreads(comments)
+}
 
-		if err := cursor.Decode(&comment); err != nil {
-			log.Println("Comment decode:", err)
+// arranges the approved comments into threads, replies to a comment readers
+// cannot see are hidden with it
+func commentThreads(comments []Comment) []Comment {
+	children := map[string][]Comment{}
+	for _, comment := range comments {
+		if comment.IsApproved() {
+			children[comment.ParentID] = append(children[comment.ParentID], comment)
 		}
-
-		comments = append(comments, comment)
 	}
 
-	var newComments []Comment
-
-	for _, comment := range comments {
-		comment.Replies = getCommentReplies(comment.ID)
-		newComments = append(newComments, comment)
+	var thread func(parentID string) []Comment
+	thread = func(parentID string) []Comment {
+		replies := children[parentID]
+		for i := range replies {
+			replies[i].Replies = thread(replies[i].ID)
+		}
+		return replies
 	}
 
-	return newComments
+	return thread("")
 }
 
-func getCommentReplies(commentID string) []Reply {
-	// fmt.Println("comment id", commentID)
-	// fmt.Println("------------------------------------------------------------------")
+// CommentThread is what the comment-thread template renders: a comment and
+// the slug of its post, which its reply form posts to wherever the thread
+// is shown, the admin preview included
+type CommentThread struct {
+	Slug    string
+	Comment Comment
+}
 
-	var replies []Reply
-	cur, err := blogReplies.Find(ctx, bson.M{"belongsto": commentID})
-	if err != nil {
-		log.Println("Error getting reply cursor", err)
-	}
-	defer cur.Close(ctx)
+func newCommentThread(slug string, comment Comment) CommentThread {
+	return CommentThread{Slug: slug, Comment: comment}
+}
 
-	if err := cur.All(ctx, &replies); err != nil {
-		log.Println("Error getting reply", err)
+// number of comments in threads, replies included
+func countComments(threads []Comment) int {
+	count := len(threads)
+	for _, comment := range threads {
+		count += countComments(comment.Replies)
 	}
-
-	return replies
+	return count
 }
 
-// get blogpost from cursor
-func getBlogPostsFromCursor(cursor *mongo.Cursor) []BlogPost {
-	var blogPosts []BlogPost
-	for cursor.Next(ctx) {
-		var post NewPost
-
-		if err := cursor.Decode(&post); err != nil {
-			log.Println("Cursor decode", err)
-		}
+// get blogposts with their comment counts from stored posts, the
+// comments themselves are only loaded for a single post
+func (s *Server) getBlogPosts(posts []NewPost) []BlogPost {
+	postIDs := []string{}
+	for _, post := range posts {
+		postIDs = append(postIDs, post.ID)
+	}
 
-		post.Comments = getPostComments(post.ID)
+	counts, err := s.store.CountComments(postIDs)
+	if err != nil {
+		log.Println("Counting comments: " + err.Error())
+	}
 
-		blogPost := BlogPost{post, len(post.Comments), post.Published.Format(time.ANSIC)}
+	var blogPosts []BlogPost
+	for _, post := range posts {
+		blogPost := BlogPost{NewPost: post, NumComment: counts[post.ID], PublishedDate: post.Published.Format(time.ANSIC)}
 
 		blogPosts = append(blogPosts, blogPost)
 	}
@@ -726,100 +1103,96 @@ func getBlogPostsFromCursor(cursor *mongo.Cursor) []BlogPost {
 }
 
 // get a single post from post id
-func getSinglePostFromID(ID string) (BlogPost, error) {
-	var singlePost NewPost
+func (s *Server) getSinglePostFromID(ID string) (BlogPost, error) {
+	singlePost, err := s.store.GetPost(ID)
+	if err != nil {
+		return BlogPost{}, err
+	}
 
-	singleResult := blogPosts.FindOne(ctx, bson.M{"id": ID})
+	return s.withComments(singlePost), nil
+}
 
-	if err := singleResult.Decode(&singlePost); err != nil {
+// get a single post from its url slug
+func (s *Server) getSinglePostFromSlug(slug string) (BlogPost, error) {
+	singlePost, err := s.store.GetPostBySlug(slug)
+	if err != nil {
 		return BlogPost{}, err
 	}
 
+	return s.withComments(singlePost), nil
+}
+
+// loads the comments and the author of a single post
+func (s *Server) withComments(singlePost NewPost) BlogPost {
+	ID := singlePost.ID
+
 	// fmt.Println("Singlepost before comment", singlePost)
 	// fmt.Println("------------------------------------------------------------------")
 
-	singlePost.Comments = getPostComments(ID)
+	singlePost.Comments = s.getPostComments(ID)
 
 	// fmt.Println("Singlepost after comment", singlePost)
 	// fmt.Println("------------------------------------------------------------------")
 
-	return BlogPost{singlePost, len(singlePost.Comments), singlePost.Published.Format(time.ANSIC)}, nil
+	blogPost := BlogPost{NewPost: singlePost, NumComment: countComments(singlePost.Comments), PublishedDate: singlePost.Published.Format(time.ANSIC)}
+
+	if author, err := s.store.GetUser(singlePost.Author); err == nil {
+		blogPost.Byline = &author
+	}
+
+	return blogPost
 }
 
-func getNewComment(r *http.Request, id string) (Comment, error) {
+// errNoParent is returned for a reply to a comment readers cannot see
+var errNoParent = errors.New("the comment you replied to does not exist")
+
+// reads a new comment on the post with id, or a reply to one of its
+// comments when the form has a parent
+func (s *Server) getNewComment(r *http.Request, id string) (Comment, error) {
 	// validate form
-	commentor, exp := template.HTMLEscaper(r.FormValue("commentor")), `^[a-zA-Z\s_]{2,35}$`
+	commentor, exp := r.FormValue("commentor"), `^[a-zA-Z\s_]{2,35}$`
 	if !valid(commentor, exp) {
 		return Comment{}, errors.New(`invalid input in name field or name not given, only "_" special character is allowed in name field a minimum of two characters and maximum of 35 characters`)
 	}
 
-	comment, exp := template.HTMLEscaper(r.FormValue("comment")), `.*`
+	comment, exp := r.FormValue("comment"), `.*`
 	if !valid(comment, exp) {
 		return Comment{}, errors.New("invalid input in comment field")
 	}
 
-	cursor, err := blogComments.Find(ctx, bson.M{})
-	if err != nil {
-		return Comment{}, errors.New("something went wrong")
-	}
-	defer cursor.Close(ctx)
-
-	for cursor.Next(ctx) {
-		var c Comment
-
-		if err := cursor.Decode(&c); err != nil {
+	parentID, depth := r.FormValue("parent"), 0
+	if parentID != "" {
+		parent, err := s.store.GetComment(parentID)
+		if err != nil && err != ErrNotFound {
 			return Comment{}, errors.New("something went wrong")
 		}
 
-		if strings.EqualFold(strings.TrimSpace(c.Commentor), strings.TrimSpace(commentor)) && strings.EqualFold(strings.TrimSpace(c.Comment), strings.TrimSpace(comment)) {
-			return Comment{}, errors.New("you already made this comment")
+		if err == ErrNotFound || parent.BelongsTo != id || !parent.IsApproved() {
+			return Comment{}, errNoParent
 		}
-	}
 
-	database_ID := primitive.NewObjectID()
-	CommentId := database_ID.String()[10:34]
-	belongsto := id
-	return Comment{database_ID, CommentId, belongsto, commentor, comment, []Reply{}}, nil
-}
-
-func getNewReply(r *http.Request, id string) (Reply, error) {
-	// validate form
-	replier, exp := template.HTMLEscaper(r.FormValue("replier")), `^[a-zA-Z\s_]{2,35}$`
-	if !valid(replier, exp) {
-		return Reply{}, errors.New(`invalid input in name field or name not given, only "_" special character is allowed in name field a minimum of two characters and maximum of 35 characters`)
+		depth = parent.Depth + 1
 	}
 
-	reply, exp := template.HTMLEscaper(r.FormValue("reply")), `.*`
-	if !valid(reply, exp) {
-		return Reply{}, errors.New("invalid input in reply field")
+	since, err := s.duplicateSince()
+	if err != nil {
+		return Comment{}, errors.New("something went wrong")
 	}
 
-	cursor, err := blogReplies.Find(ctx, bson.M{})
+	hash := contentHash(commentor, comment)
+	duplicate, err := s.store.HasDuplicateComment(id, parentID, hash, since)
 	if err != nil {
-		return Reply{}, errors.New("something went wrong")
+		return Comment{}, errors.New("something went wrong")
 	}
-	defer cursor.Close(ctx)
-
-	for cursor.Next(ctx) {
-		var r Reply
-
-		if err := cursor.Decode(&r); err != nil {
-			return Reply{}, errors.New("something went wrong")
-		}
 
-		if strings.EqualFold(strings.TrimSpace(r.Replier), strings.TrimSpace(replier)) && strings.EqualFold(strings.TrimSpace(r.Reply), strings.TrimSpace(reply)) {
-			log.Println("Re replying")
-			return Reply{}, errors.New("you already made this reply")
-		}
-
-		// if strings.ToLower(strings.TrimSpace(r.Replier)) == strings.ToLower(strings.TrimSpace(replier)) && strings.ToLower(strings.TrimSpace(r.Reply)) == strings.ToLower(strings.TrimSpace(reply)) {
-		// 	return Reply{}, errors.New("you already made this reply")
-		// }
+	if duplicate {
+		return Comment{}, errDuplicateComment
 	}
 
 	database_ID := primitive.NewObjectID()
+	CommentId := database_ID.String()[10:34]
 	belongsto := id
-	return Reply{database_ID, belongsto, replier, reply}, nil
+	return Comment{DatabaseID: database_ID, ID: CommentId, BelongsTo: belongsto, ParentID: parentID, Depth: depth, Commentor: commentor, Comment: comment, Status: CommentPending, ContentHash: hash}, nil
 }
 
 // reduce blog content for home page
@@ -890,83 +1263,49 @@ func checkIfEmailIsRegistered(email string) error {
 	return nil
 }
 
-// send mail with gmail IMAP
-func sendWelcomeMail(email string) error {
-	mail := gomail.NewMessage()
-
-	mail.SetHeader("From", mail.FormatAddress("oyebodeamirdeen@outlook.com", "Needrima"))
-
-	mail.SetHeaders(map[string][]string{
-		"To":      {email},
-		"Subject": {"Welcome to Needrima's Blog"},
-	})
-
-	password := os.Getenv("emailPassword")
-
-	mail.SetBody("text/html", `Welcome to Needrima's blog. I'm Needrima and I'm pleased to have you on board. <a style="color:red;" href="http://needrimasblog.herokuapp.com">Visit</a> now to start reading my latest posts.`)
-
-	dialer := gomail.NewDialer("smtp.gmail.com", 587, "oyebodeamirdeen@gmail.com", password)
-
-	dialer.TLSConfig = &tls.Config{InsecureSkipVerify: true}
-
-	if err := dialer.DialAndSend(mail); err != nil {
-		fmt.Println("Error sending mail:", err)
-		return errors.New("sending welcome message failed")
+// queues the welcome mail of a new subscriber
+func (s *Server) sendWelcomeMail(sub Subscriber) error {
+	err := s.queueSubscriberMail("welcome", sub, "Welcome to Needrima's Blog",
+		`Welcome to Needrima's blog. I'm Needrima and I'm pleased to have you on board. <a style="color:red;" href="`+siteURL()+`">Visit</a> now to start reading my latest posts.`)
+	if err != nil {
+		return errors.New("queueing welcome message failed: " + err.Error())
 	}
 
 	return nil
 }
 
-// gets subscribers emails from database and return their mails
-func getAllSubscribers() ([]string, error) {
-	cursor, err := emails.Find(ctx, bson.M{})
+// queues a mail about a post that just went live for every subscriber, one
+// each so they do not see each other's addresses and one bad address does
+// not hold back the others
+func (s *Server) notifySubscribers(post NewPost) {
+	subscribers, err := s.store.GetSubscribers()
 	if err != nil {
-		return []string{}, errors.New("querying database failed")
+		log.Println("Finding subscribers:", err)
+		return
 	}
-	defer cursor.Close(ctx)
-
-	var emails []string
 
-	for cursor.Next(ctx) {
-		var sub Subscriber
-
-		if err := cursor.Decode(&sub); err != nil {
-			log.Println("Error getting subsciber email")
+	queued := 0
+	for _, sub := range subscribers {
+		if !sub.WantsPost(post) {
 			continue
 		}
 
-		emails = append(emails, sub.Mail)
+		if err := s.sendMailOnNewBlogPost(sub, post.Slug, post.Title); err != nil {
+			log.Println(err)
+			continue
+		}
+		queued++
 	}
 
-	//fmt.Println(emails)
-
-	return emails, nil
+	log.Println("Queued", queued, "mails about post", post.ID)
 }
 
-// send mail on new blogpost to all subscribers
-func sendMailOnNewBlogPost(emails []string, blogId, title string) error {
-	mail := gomail.NewMessage()
-
-	mail.SetHeader("From", mail.FormatAddress("oyebodeamirdeen@outlook.com", "Needrima"))
-
-	mail.SetHeaders(map[string][]string{
-		"To":      emails,
-		"Subject": {title + " at Needrima's blog"},
-	})
-
-	password := os.Getenv("emailPassword")
-
-	body := fmt.Sprintf(`I just posted a new blog titled <b>%s</b> check it out <a style="color:red;" href="http://needrimasblog.herokuapp.com/blog/%s">Here</a>.`, title, blogId)
-
-	mail.SetBody("text/html", body)
-
-	dialer := gomail.NewDialer("smtp.gmail.com", 587, "oyebodeamirdeen@gmail.com", password)
-
-	dialer.TLSConfig = &tls.Config{InsecureSkipVerify: true}
-
-	if err := dialer.DialAndSend(mail); err != nil {
-		fmt.Println("Error sending mail:", err)
-		return errors.New("sending new blog message failed")
+// queues the mail on new blogpost to a subscriber
+func (s *Server) sendMailOnNewBlogPost(sub Subscriber, slug, title string) error {
+	err := s.queueSubscriberMail("new-post", sub, title+" at Needrima's blog",
+		fmt.Sprintf(`I just posted a new blog titled <b>%s</b> check it out <a style="color:red;" href="%s/blog/%s">Here</a>.`, template.HTMLEscapeString(title), siteURL(), slug))
+	if err != nil {
+		return errors.New("queueing new blog message to " + sub.Mail + " failed: " + err.Error())
 	}
 
 	return nil
@@ -0,0 +1,623 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const testPassword = "correct horse"
+
+// server on a memory store with an owner account, subscriber addresses are
+// not checked with the debounce API
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+
+	t.Setenv("sessionSecret", "test secret")
+	s := NewServer(newMemoryStore(), logMailer{})
+	s.emailCheck = func(email string) error { return nil }
+
+	owner := newUser("admin", RoleOwner)
+	if err := owner.setPassword(testPassword); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.store.InsertUser(owner); err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+// stores a post and returns it
+func addTestPost(t *testing.T, s *Server, title, status string, published time.Time) NewPost {
+	t.Helper()
+
+	post := NewPost{
+		DatabaseID: primitive.NewObjectID(),
+		Title:      title,
+		Published:  published,
+		Content:    "Content of " + title,
+		Format:     FormatMarkdown,
+		Status:     status,
+	}
+	post.ID = post.DatabaseID.Hex()
+	if err := s.assignSlug(&post); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.store.InsertPost(post); err != nil {
+		t.Fatal(err)
+	}
+
+	return post
+}
+
+// testClient keeps the cookies of a browser between requests
+type testClient struct {
+	t       *testing.T
+	s       *Server
+	handler http.Handler
+	cookies map[string]*http.Cookie
+}
+
+func newTestClient(t *testing.T, s *Server) *testClient {
+	return &testClient{t: t, s: s, handler: s.routes(), cookies: map[string]*http.Cookie{}}
+}
+
+func (c *testClient) do(r *http.Request) *httptest.ResponseRecorder {
+	for _, cookie := range c.cookies {
+		r.AddCookie(cookie)
+	}
+
+	w := httptest.NewRecorder()
+	c.handler.ServeHTTP(w, r)
+
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.MaxAge < 0 {
+			delete(c.cookies, cookie.Name)
+			continue
+		}
+		c.cookies[cookie.Name] = cookie
+	}
+
+	return w
+}
+
+func (c *testClient) get(path string) *httptest.ResponseRecorder {
+	return c.do(httptest.NewRequest(http.MethodGet, path, nil))
+}
+
+// posts form with the csrf token of the client, getting a csrf cookie first
+// if it has none
+func (c *testClient) post(path string, form url.Values) *httptest.ResponseRecorder {
+	form.Set(csrfField, c.csrfToken())
+	return c.postRaw(path, form)
+}
+
+// posts form as it is
+func (c *testClient) postRaw(path string, form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return c.do(r)
+}
+
+// posts form as multipart with the csrf token, like the post editor does,
+// image is sent as blogImage when it is not empty
+func (c *testClient) postMultipart(path string, form url.Values, image string) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	form.Set(csrfField, c.csrfToken())
+	for key, values := range form {
+		for _, value := range values {
+			mw.WriteField(key, value)
+		}
+	}
+
+	if image != "" {
+		part, err := mw.CreateFormFile("blogImage", image)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		part.Write([]byte("\x89PNG\r\n\x1a\n"))
+	}
+	mw.Close()
+
+	r := httptest.NewRequest(http.MethodPost, path, &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return c.do(r)
+}
+
+func (c *testClient) csrfToken() string {
+	if _, ok := c.cookies[csrfCookie]; !ok {
+		c.get("/about")
+	}
+
+	return c.s.csrfToken(c.cookies[csrfCookie].Value)
+}
+
+// signs the client in as the owner
+func (c *testClient) login() {
+	c.t.Helper()
+
+	w := c.post("/admin/login", url.Values{"username": {"admin"}, "password": {testPassword}})
+	if w.Code != http.StatusSeeOther {
+		c.t.Fatalf("login: got status %d, want %d", w.Code, http.StatusSeeOther)
+	}
+	if _, ok := c.cookies[sessionCookie]; !ok {
+		c.t.Fatal("login did not set a session cookie")
+	}
+}
+
+func assertStatus(t *testing.T, w *httptest.ResponseRecorder, want int) {
+	t.Helper()
+
+	if w.Code != want {
+		t.Fatalf("got status %d, want %d, body:\n%s", w.Code, want, w.Body.String())
+	}
+}
+
+func assertRedirect(t *testing.T, w *httptest.ResponseRecorder, status int, location string) {
+	t.Helper()
+
+	assertStatus(t, w, status)
+	if got := w.Header().Get("Location"); got != location {
+		t.Fatalf("redirected to %q, want %q", got, location)
+	}
+}
+
+func assertBody(t *testing.T, w *httptest.ResponseRecorder, want ...string) {
+	t.Helper()
+
+	for _, text := range want {
+		if !strings.Contains(w.Body.String(), text) {
+			t.Fatalf("body does not contain %q:\n%s", text, w.Body.String())
+		}
+	}
+}
+
+func assertNotInBody(t *testing.T, w *httptest.ResponseRecorder, unwanted ...string) {
+	t.Helper()
+
+	for _, text := range unwanted {
+		if strings.Contains(w.Body.String(), text) {
+			t.Fatalf("body contains %q:\n%s", text, w.Body.String())
+		}
+	}
+}
+
+func TestHomePages(t *testing.T) {
+	s := newTestServer(t)
+	c := newTestClient(t, s)
+
+	// ten posts, newest first on the home page
+	start := time.Now().Add(-time.Hour)
+	for i := 1; i <= 10; i++ {
+		addTestPost(t, s, "Post number "+strconv.Itoa(i), PostPublished, start.Add(time.Duration(i)*time.Minute))
+	}
+	addTestPost(t, s, "Unfinished draft", PostDraft, time.Now())
+
+	assertRedirect(t, c.get("/"), http.StatusSeeOther, "/home")
+
+	w := c.get("/home")
+	assertStatus(t, w, http.StatusOK)
+	assertBody(t, w, "Post number 10", "Post number 3", `href="/blog/post-number-10"`)
+	assertNotInBody(t, w, "Post number 2<", "Post number 1<", "Unfinished draft")
+
+	w = c.get("/next/1")
+	assertStatus(t, w, http.StatusOK)
+	assertBody(t, w, "Post number 2", "Post number 1")
+	assertNotInBody(t, w, "Post number 3", "Unfinished draft")
+
+	// past the last page
+	assertRedirect(t, c.get("/next/2"), http.StatusSeeOther, "/previous/1")
+
+	w = c.get("/previous/1")
+	assertStatus(t, w, http.StatusOK)
+	assertBody(t, w, "Post number 2", "Post number 1")
+
+	assertRedirect(t, c.get("/previous/0"), http.StatusSeeOther, "/home")
+	assertRedirect(t, c.get("/next/-1"), http.StatusSeeOther, "/home")
+	assertRedirect(t, c.get("/previous/-1"), http.StatusSeeOther, "/home")
+
+	if posts, err := s.store.GetPosts(PostFilter{PublishedOnly: true}, -8, 8); err != nil || len(posts) != 8 {
+		t.Fatalf("negative skip: got %d posts, error %v, want the first 8", len(posts), err)
+	}
+
+	r := httptest.NewRequest(http.MethodDelete, "/home", nil)
+	r.Header.Set(csrfHeader, c.csrfToken())
+	w = c.do(r)
+	assertStatus(t, w, http.StatusMethodNotAllowed)
+}
+
+func TestBlog(t *testing.T) {
+	s := newTestServer(t)
+	c := newTestClient(t, s)
+
+	post := addTestPost(t, s, "Hello World", PostPublished, time.Now())
+	draft := addTestPost(t, s, "Not Yet", PostDraft, time.Now())
+
+	w := c.get("/blog/hello-world")
+	assertStatus(t, w, http.StatusOK)
+	assertBody(t, w, "Hello World", "Content of Hello World")
+
+	// links from before slugs existed
+	assertRedirect(t, c.get("/blog/"+post.ID), http.StatusMovedPermanently, "/blog/hello-world")
+
+	assertStatus(t, c.get("/blog/no-such-post"), http.StatusNotFound)
+	assertStatus(t, c.get("/blog/"+draft.Slug), http.StatusNotFound)
+
+	// the old ID and old slugs of an unpublished post do not give its
+	// current slug away
+	assertStatus(t, c.get("/blog/"+draft.ID), http.StatusNotFound)
+
+	renamed := post
+	renamed.Slug = "new-title"
+	if err := s.store.UpdatePost(renamed); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.keepOldSlug(post, renamed); err != nil {
+		t.Fatal(err)
+	}
+	assertRedirect(t, c.get("/blog/hello-world"), http.StatusMovedPermanently, "/blog/new-title")
+
+	renamed.Status = PostDraft
+	if err := s.store.UpdatePost(renamed); err != nil {
+		t.Fatal(err)
+	}
+	assertStatus(t, c.get("/blog/hello-world"), http.StatusNotFound)
+	assertStatus(t, c.get("/blog/"+post.ID), http.StatusNotFound)
+}
+
+func TestPreviewAssets(t *testing.T) {
+	s := newTestServer(t)
+	c := newTestClient(t, s)
+	c.login()
+
+	draft := addTestPost(t, s, "Draft Preview", PostDraft, time.Now())
+
+	// the preview is one level deeper than /blog/{slug}, relative asset
+	// links would miss
+	w := c.get("/admin/preview/" + draft.ID)
+	assertStatus(t, w, http.StatusOK)
+	assertBody(t, w, "Draft Preview", `href="/assets/css/theme-1.css"`)
+	assertNotInBody(t, w, `"../assets/`)
+
+	assertStatus(t, c.get("/assets/css/theme-1.css"), http.StatusOK)
+}
+
+func TestAbout(t *testing.T) {
+	c := newTestClient(t, newTestServer(t))
+
+	w := c.get("/about")
+	assertStatus(t, w, http.StatusOK)
+	assertBody(t, w, `name="`+csrfField+`"`)
+}
+
+func TestSubscribe(t *testing.T) {
+	s := newTestServer(t)
+	c := newTestClient(t, s)
+
+	w := c.post("/home", url.Values{"semail1": {"reader@example.com"}})
+	assertStatus(t, w, http.StatusOK)
+	assertBody(t, w, "Check your inbox")
+
+	sub, err := s.store.GetSubscriberByMail("reader@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.Status != SubscriberPending || sub.Token == "" {
+		t.Fatalf("got subscriber %+v, want a pending one with a token", sub)
+	}
+
+	jobs, err := s.store.GetMailJobs(MailQueued, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || !strings.Contains(jobs[0].Message.HTML, "/subscribe/confirm?token="+sub.Token) {
+		t.Fatalf("got mail jobs %+v, want the confirmation mail", jobs)
+	}
+
+	w = c.post("/home", url.Values{"semail1": {"not an address"}})
+	assertStatus(t, w, http.StatusInternalServerError)
+	assertBody(t, w, "invalid email address")
+
+	s.emailCheck = func(email string) error { return errors.New("unregistered") }
+	w = c.post("/about", url.Values{"semail1": {"nobody@example.com"}})
+	assertStatus(t, w, http.StatusBadRequest)
+	assertBody(t, w, "Email not deliverable")
+}
+
+func TestCSRF(t *testing.T) {
+	s := newTestServer(t)
+	c := newTestClient(t, s)
+
+	w := c.postRaw("/admin/login", url.Values{"username": {"admin"}, "password": {testPassword}})
+	assertStatus(t, w, http.StatusForbidden)
+	if _, ok := c.cookies[sessionCookie]; ok {
+		t.Fatal("signed in without a csrf token")
+	}
+
+	// a token of another browser
+	other := newTestClient(t, s)
+	w = c.postRaw("/home", url.Values{"semail1": {"reader@example.com"}, csrfField: {other.csrfToken()}})
+	assertStatus(t, w, http.StatusForbidden)
+
+	// the token in the header works too
+	r := httptest.NewRequest(http.MethodPost, "/admin/login", strings.NewReader(url.Values{"username": {"admin"}, "password": {testPassword}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set(csrfHeader, c.csrfToken())
+	assertRedirect(t, c.do(r), http.StatusSeeOther, "/admin/posts")
+}
+
+func TestLogin(t *testing.T) {
+	s := newTestServer(t)
+	c := newTestClient(t, s)
+
+	// admin pages send visitors to the login page, and back after it
+	assertRedirect(t, c.get("/admin/new?x=1&y=2"), http.StatusSeeOther, "/admin/login?next="+url.QueryEscape("/admin/new?x=1&y=2"))
+
+	w := c.get("/admin/login?next=" + url.QueryEscape("/admin/new"))
+	assertStatus(t, w, http.StatusOK)
+	assertBody(t, w, `value="/admin/new"`)
+
+	w = c.post("/admin/login", url.Values{"username": {"admin"}, "password": {"wrong password"}})
+	assertStatus(t, w, http.StatusUnauthorized)
+	assertBody(t, w, errBadLogin.Error())
+	if _, ok := c.cookies[sessionCookie]; ok {
+		t.Fatal("signed in with a wrong password")
+	}
+
+	w = c.post("/admin/login", url.Values{"username": {"admin"}, "password": {testPassword}, "next": {"/admin/new"}})
+	assertRedirect(t, w, http.StatusSeeOther, "/admin/new")
+
+	assertStatus(t, c.get("/admin/new"), http.StatusOK)
+
+	// signed in already
+	assertRedirect(t, c.get("/admin/login"), http.StatusSeeOther, "/admin/posts")
+
+	assertRedirect(t, c.post("/admin/logout", url.Values{}), http.StatusSeeOther, "/admin/login")
+	assertRedirect(t, c.get("/admin/posts"), http.StatusSeeOther, "/admin/login?next="+url.QueryEscape("/admin/posts"))
+}
+
+func TestLoginNextStaysOnSite(t *testing.T) {
+	for _, next := range []string{"//evil.example", "/\\evil.example", "https://evil.example/admin/", "/home"} {
+		c := newTestClient(t, newTestServer(t))
+
+		w := c.post("/admin/login", url.Values{"username": {"admin"}, "password": {testPassword}, "next": {next}})
+		assertRedirect(t, w, http.StatusSeeOther, "/admin/posts")
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	c := newTestClient(t, newTestServer(t))
+
+	for i := 0; i < maxLoginFailures; i++ {
+		c.post("/admin/login", url.Values{"username": {"admin"}, "password": {"wrong password"}})
+	}
+
+	// even the right password is refused while locked out
+	w := c.post("/admin/login", url.Values{"username": {"admin"}, "password": {testPassword}})
+	assertStatus(t, w, http.StatusUnauthorized)
+	assertBody(t, w, errLockedLogin.Error())
+}
+
+func TestPostEditing(t *testing.T) {
+	s := newTestServer(t)
+	c := newTestClient(t, s)
+	c.login()
+
+	w := c.get("/admin/new")
+	assertStatus(t, w, http.StatusOK)
+	assertBody(t, w, `action="/admin/new"`)
+
+	form := url.Values{"title": {"A New Post"}, "content": {"Some *markdown*"}, "tags": {"go, testing"}, "status": {PostPublished}}
+	w = c.postMultipart("/admin/new", form, "cover.png")
+	assertStatus(t, w, http.StatusOK)
+	assertBody(t, w, "Post added")
+
+	post, err := s.store.GetPostBySlug("a-new-post")
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := filepath.Join("assets/images/blog", post.ImageName)
+	t.Cleanup(func() { os.Remove(image) })
+	if _, err := os.Stat(image); err != nil {
+		t.Fatal("uploaded image: " + err.Error())
+	}
+
+	w = c.get("/blog/a-new-post")
+	assertStatus(t, w, http.StatusOK)
+	assertBody(t, w, "A New Post", "<em>markdown</em>")
+
+	// a new post needs an image
+	w = c.postMultipart("/admin/new", url.Values{"title": {"No Image"}, "content": {"text"}}, "")
+	assertStatus(t, w, http.StatusInternalServerError)
+
+	w = c.get("/admin/edit/" + post.ID)
+	assertStatus(t, w, http.StatusOK)
+	assertBody(t, w, `value="A New Post"`)
+
+	form = url.Values{"title": {"A Renamed Post"}, "content": {"Other content"}, "status": {PostPublished}}
+	w = c.postMultipart("/admin/edit/"+post.ID, form, "")
+	assertStatus(t, w, http.StatusOK)
+	assertBody(t, w, "Post updated")
+
+	w = c.get("/blog/a-renamed-post")
+	assertStatus(t, w, http.StatusOK)
+	assertBody(t, w, "A Renamed Post", "Other content")
+	assertRedirect(t, c.get("/blog/a-new-post"), http.StatusMovedPermanently, "/blog/a-renamed-post")
+
+	assertStatus(t, c.get("/admin/edit/no-such-post"), http.StatusOK) // the page-end page
+
+	w = c.get("/admin/delete/" + post.ID)
+	assertStatus(t, w, http.StatusOK)
+	assertBody(t, w, `Delete "A Renamed Post"?`, "2 revision(s)")
+
+	w = c.post("/admin/delete/"+post.ID, url.Values{})
+	assertStatus(t, w, http.StatusOK)
+	assertBody(t, w, "A Renamed Post", post.ImageName)
+
+	if _, err := s.store.GetPost(post.ID); err != ErrNotFound {
+		t.Fatalf("got %v for the deleted post, want ErrNotFound", err)
+	}
+	if _, err := os.Stat(image); !os.IsNotExist(err) {
+		t.Fatal("the image of the deleted post was kept")
+	}
+	assertStatus(t, c.get("/blog/a-renamed-post"), http.StatusNotFound)
+}
+
+// posts a comment, or a reply when parent is set, as a reader who took a
+// minute to write it
+func (c *testClient) comment(slug, name, text, parent string) *httptest.ResponseRecorder {
+	form := url.Values{"commentor": {name}, "comment": {text}, formStampField: {c.s.formStamp(time.Now().Add(-time.Minute))}}
+	if parent != "" {
+		form.Set("parent", parent)
+	}
+	return c.post("/blog/"+slug, form)
+}
+
+// ID of the comment a comment redirect points to
+func commentIDFromRedirect(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+
+	assertStatus(t, w, http.StatusSeeOther)
+	location := w.Header().Get("Location")
+	i := strings.Index(location, "#comment-")
+	if i < 0 {
+		t.Fatalf("redirected to %q, not to a comment", location)
+	}
+	return location[i+len("#comment-"):]
+}
+
+func TestCommentThreads(t *testing.T) {
+	comments := []Comment{
+		{ID: "a", Status: CommentApproved},
+		{ID: "a1", ParentID: "a", Depth: 1, Status: CommentApproved},
+		{ID: "a1x", ParentID: "a1", Depth: 2}, // stored before moderation
+		{ID: "a2", ParentID: "a", Depth: 1, Status: CommentPending},
+		{ID: "a2x", ParentID: "a2", Depth: 2, Status: CommentApproved}, // under a pending reply
+		{ID: "b", Status: CommentSpam},
+		{ID: "c", Status: CommentApproved},
+	}
+
+	threads := commentThreads(comments)
+	if len(threads) != 2 || threads[0].ID != "a" || threads[1].ID != "c" {
+		t.Fatalf("got threads %+v, want a and c", threads)
+	}
+	if replies := threads[0].Replies; len(replies) != 1 || replies[0].ID != "a1" || len(replies[0].Replies) != 1 || replies[0].Replies[0].ID != "a1x" {
+		t.Fatalf("got replies %+v to a, want a1 with a1x", replies)
+	}
+	if count := countComments(threads); count != 4 {
+		t.Fatalf("counted %d comments, want 4", count)
+	}
+}
+
+func TestReplies(t *testing.T) {
+	s := newTestServer(t)
+	c := newTestClient(t, s)
+	if err := s.store.SetSetting(settingModeration, ModerateNone); err != nil {
+		t.Fatal(err)
+	}
+
+	post := addTestPost(t, s, "Threads", PostPublished, time.Now())
+	other := addTestPost(t, s, "Elsewhere", PostPublished, time.Now())
+
+	// a thread seven comments deep
+	parent, ids := "", []string{}
+	for depth := 0; depth < 7; depth++ {
+		w := c.comment(post.Slug, "Reader", "comment at depth "+strconv.Itoa(depth), parent)
+		parent = commentIDFromRedirect(t, w)
+		ids = append(ids, parent)
+
+		stored, err := s.store.GetComment(parent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Depth != depth || stored.BelongsTo != post.ID {
+			t.Fatalf("got depth %d on post %s, want %d on %s", stored.Depth, stored.BelongsTo, depth, post.ID)
+		}
+	}
+
+	// replies are indented up to the fifth level, deeper ones line up
+	// with it
+	w := c.get("/blog/" + post.Slug)
+	assertStatus(t, w, http.StatusOK)
+	assertBody(t, w, "comment at depth 6", `action="/blog/threads#comment-`+ids[6]+`"`)
+	if indents := strings.Count(w.Body.String(), `style="margin-left: 30px;"`); indents != 5 {
+		t.Fatalf("got %d indented comments, want 5", indents)
+	}
+
+	// the parent must be an approved comment of the same post
+	w = c.comment(other.Slug, "Reader", "wrong post", ids[0])
+	assertStatus(t, w, http.StatusBadRequest)
+	assertBody(t, w, errNoParent.Error())
+
+	w = c.comment(post.Slug, "Reader", "no such parent", "nope")
+	assertStatus(t, w, http.StatusBadRequest)
+
+	// old reply links go to the comment on its post
+	assertRedirect(t, c.get("/reply/"+ids[2]), http.StatusMovedPermanently, "/blog/threads#comment-"+ids[2])
+
+	if err := s.store.SetCommentStatus(ids[1], CommentPending, ""); err != nil {
+		t.Fatal(err)
+	}
+	w = c.get("/reply/" + ids[1])
+	assertStatus(t, w, http.StatusOK)
+	assertNotInBody(t, w, "comment-"+ids[1])
+
+	// nothing under a pending comment shows
+	w = c.get("/blog/" + post.Slug)
+	assertBody(t, w, "comment at depth 0")
+	assertNotInBody(t, w, "comment at depth 1", "comment at depth 6")
+}
+
+func TestDeleteCommentCascades(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		tree := []Comment{
+			{ID: "a"},
+			{ID: "a1", ParentID: "a", Depth: 1},
+			{ID: "a1x", ParentID: "a1", Depth: 2},
+			{ID: "a1xy", ParentID: "a1x", Depth: 3},
+			{ID: "a2", ParentID: "a", Depth: 1},
+			{ID: "b"},
+		}
+		for _, comment := range tree {
+			comment.DatabaseID, comment.BelongsTo, comment.Commentor, comment.Comment, comment.Status = primitive.NewObjectID(), "p1", "Reader", "text "+comment.ID, CommentApproved
+			if err := store.InsertComment(comment); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := store.DeleteComment("a1"); err != nil {
+			t.Fatal(err)
+		}
+
+		comments, err := store.GetComments("p1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var left []string
+		for _, comment := range comments {
+			left = append(left, comment.ID)
+		}
+		if strings.Join(left, " ") != "a a2 b" {
+			t.Fatalf("left %v, want a a2 b", left)
+		}
+
+		if err := store.DeleteComment("a1"); err != ErrNotFound {
+			t.Fatalf("deleting again: got %v, want ErrNotFound", err)
+		}
+	})
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"html"
+	"html/template"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+// content formats of a post. Posts stored before Markdown have no format,
+// their content is plain text laid out with the bullet point and quote fields.
+const (
+	FormatLegacy   = ""
+	FormatMarkdown = "markdown"
+)
+
+var (
+	// CommonMark with the GitHub extensions: tables, strikethrough,
+	// autolinks and task lists
+	markdown = goldmark.New(goldmark.WithExtensions(extension.GFM))
+
+	// what rendered posts may contain, anything else (scripts, iframes,
+	// event handlers, ...) is stripped
+	markdownPolicy = newMarkdownPolicy()
+
+	// removes every tag, used for plain text excerpts
+	textPolicy = bluemonday.StrictPolicy()
+)
+
+func newMarkdownPolicy() *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+
+	// code block languages for syntax highlighters
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^language-[\w+#-]+$`)).OnElements("code")
+
+	// task list checkboxes
+	p.AllowAttrs("type").Matching(regexp.MustCompile(`^checkbox$`)).OnElements("input")
+	p.AllowAttrs("checked", "disabled").OnElements("input")
+
+	return p
+}
+
+// renders Markdown source to sanitized HTML. This is the only place
+// templates are handed HTML they do not escape.
+func renderMarkdown(source string) template.HTML {
+	var buf bytes.Buffer
+	if err := markdown.Convert([]byte(source), &buf); err != nil {
+		log.Println("Rendering markdown:", err)
+		return template.HTML(html.EscapeString(source))
+	}
+
+	return template.HTML(markdownPolicy.Sanitize(buf.String()))
+}
+
+// text of Markdown source without any markup
+func markdownText(source string) string {
+	var buf bytes.Buffer
+	if err := markdown.Convert([]byte(source), &buf); err != nil {
+		return source
+	}
+
+	return strings.Join(strings.Fields(html.UnescapeString(textPolicy.Sanitize(buf.String()))), " ")
+}
+
+// content of the post as plain text, for excerpts
+func (p NewPost) PlainContent() string {
+	if p.Format == FormatMarkdown {
+		return markdownText(p.Content)
+	}
+	return p.Content
+}
+
+// Markdown with the same layout blog-post.html gives a legacy post: the
+// content followed by the bullet points and the quote
+func legacyMarkdown(post NewPost) string {
+	var b strings.Builder
+
+	b.WriteString(post.Content + "\n")
+
+	// the template only shows them with a bullet point title
+	if post.BpTitle == "" {
+		return b.String()
+	}
+
+	b.WriteString("\n##### " + post.BpTitle + ":\n\n")
+	for _, point := range post.BulletPoints {
+		b.WriteString("- " + point + ".\n")
+	}
+
+	b.WriteString("\n##### " + post.BqTitle + ":\n\n")
+	b.WriteString("> " + post.BlogQuote + ".\n>\n")
+	b.WriteString("> — " + post.QuoteAuthor + "\n")
+
+	return b.String()
+}
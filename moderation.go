@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// moderation statuses of comments. Those stored before moderation existed
+// have none and count as approved.
+const (
+	CommentPending  = "pending"
+	CommentApproved = "approved"
+	CommentRejected = "rejected"
+	CommentSpam     = "spam"
+)
+
+var commentStatuses = []string{CommentPending, CommentApproved, CommentRejected, CommentSpam}
+
+// reports if readers can see the comment
+func (c Comment) IsApproved() bool {
+	return c.Status == "" || c.Status == CommentApproved
+}
+
+// site setting choosing which new comments wait for a moderator
+const (
+	settingModeration = "comment-moderation"
+
+	ModerateAll       = "all"        // every comment
+	ModerateFirstTime = "first-time" // comments from browsers without an approved comment yet, see commenterKey
+	ModerateNone      = "none"       // publish immediately
+
+	defaultModeration = ModerateFirstTime
+)
+
+var moderationModes = []string{ModerateAll, ModerateFirstTime, ModerateNone}
+
+// current moderation mode of the site
+func (s *Server) moderationMode() (string, error) {
+	mode, err := s.store.GetSetting(settingModeration)
+	if err == ErrNotFound || (err == nil && !Found(moderationModes, mode)) {
+		return defaultModeration, nil
+	}
+
+	return mode, err
+}
+
+// status a new comment from the browser with the commenter key gets
+func (s *Server) moderationStatus(commenter string) (string, error) {
+	mode, err := s.moderationMode()
+	if err != nil {
+		return "", err
+	}
+
+	switch mode {
+	case ModerateNone:
+		return CommentApproved, nil
+	case ModerateFirstTime:
+		known, err := s.store.IsApprovedCommenter(commenter)
+		if err != nil {
+			return "", err
+		}
+
+		if known {
+			return CommentApproved, nil
+		}
+	}
+
+	return CommentPending, nil
+}
+
+const (
+	commenterCookie   = "commenter"
+	commenterLifetime = 365 * 24 * time.Hour
+)
+
+// random key of the browser posting a comment, kept in a signed cookie. The
+// first-time moderation mode trusts browsers with an approved comment, not
+// names, which anyone can type. A new key is set when there is no valid one.
+func (s *Server) commenterKey(w http.ResponseWriter, r *http.Request) string {
+	if cookie, err := r.Cookie(commenterCookie); err == nil {
+		parts := strings.SplitN(cookie.Value, ".", 2)
+		if len(parts) == 2 && hmac.Equal([]byte(s.sign("commenter:"+parts[0])), []byte(parts[1])) {
+			return parts[0]
+		}
+	}
+
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		log.Fatal("commenter key: " + err.Error())
+	}
+	key := hex.EncodeToString(random)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     commenterCookie,
+		Value:    key + "." + s.sign("commenter:"+key),
+		Path:     "/",
+		MaxAge:   int(commenterLifetime.Seconds()),
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return key
+}
+
+// data of the moderation queue
+type AdminCommentsPage struct {
+	User     User
+	Status   string // listed
+	Statuses []string
+	Comments []Comment
+	Parents  map[string]Comment // ID: comment a listed reply replies to
+	Posts    map[string]NewPost // ID: post the comments belong to
+	Mode     string             // moderation mode of the site
+	Modes    []string
+	Spam     SpamConfig
+	Message  string
+}
+
+// the moderation queue: lists comments by status and approves,
+// rejects, marks as spam or deletes the selected ones
+func (s *Server) AdminComments(w http.ResponseWriter, r *http.Request) {
+	if !ValidMethod(r) {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data := AdminCommentsPage{
+		User:     currentUser(r),
+		Status:   r.FormValue("status"),
+		Statuses: commentStatuses,
+		Parents:  map[string]Comment{},
+		Posts:    map[string]NewPost{},
+		Modes:    moderationModes,
+	}
+
+	if !Found(commentStatuses, data.Status) {
+		data.Status = CommentPending
+	}
+
+	if r.Method == http.MethodPost {
+		r.ParseForm()
+
+		done, err := s.moderate(r.FormValue("action"), r.Form["comment"])
+		if err != nil {
+			http.Error(w, "Moderating: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		data.Message = done
+	}
+
+	var err error
+	if data.Mode, err = s.moderationMode(); err != nil {
+		http.Error(w, "Finding settings: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if data.Spam, err = loadSpamConfig(s.store); err != nil {
+		http.Error(w, "Finding settings: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	comments, err := s.store.GetCommentsByStatus(data.Status)
+	if err != nil {
+		http.Error(w, "Finding comments: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// newest first
+	for i := len(comments) - 1; i >= 0; i-- {
+		data.Comments = append(data.Comments, comments[i])
+		s.addQueuePost(data.Posts, comments[i].BelongsTo)
+
+		if parentID := comments[i].ParentID; parentID != "" {
+			if _, ok := data.Parents[parentID]; !ok {
+				if parent, err := s.store.GetComment(parentID); err == nil {
+					data.Parents[parentID] = parent
+				}
+			}
+		}
+	}
+
+	templates(r).ExecuteTemplate(w, "admin-comments.html", data)
+}
+
+func (s *Server) addQueuePost(posts map[string]NewPost, ID string) {
+	if _, ok := posts[ID]; ok {
+		return
+	}
+
+	if post, err := s.store.GetPost(ID); err == nil {
+		posts[ID] = post
+	}
+}
+
+// applies a queue action to the comments with the given IDs and describes
+// what it did. Approving and marking as spam train the spam classifier,
+// rejecting takes back what it learnt.
+func (s *Server) moderate(action string, commentIDs []string) (string, error) {
+	status, class := "", ""
+	switch action {
+	case "approve":
+		status, class = CommentApproved, classHam
+	case "reject":
+		status = CommentRejected
+	case "spam":
+		status, class = CommentSpam, classSpam
+	case "delete":
+	default:
+		return "", errors.New("unknown action " + action)
+	}
+
+	for _, ID := range commentIDs {
+		var err error
+		if action == "delete" {
+			err = s.store.DeleteComment(ID)
+		} else {
+			err = s.moderateComment(ID, status, class)
+		}
+
+		if err != nil && err != ErrNotFound {
+			return "", err
+		}
+	}
+
+	total := strconv.Itoa(len(commentIDs))
+	if action == "delete" {
+		return total + " deleted", nil
+	}
+	return total + " marked " + status, nil
+}
+
+func (s *Server) moderateComment(ID, status, class string) error {
+	comment, err := s.store.GetComment(ID)
+	if err != nil {
+		return err
+	}
+
+	if err := s.classifier.retrain(comment.Commentor, comment.Comment, comment.Trained, class); err != nil {
+		return err
+	}
+
+	return s.store.SetCommentStatus(ID, status, class)
+}
+
+// changes the moderation mode and the spam filter settings of the site
+func (s *Server) AdminSettings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mode := r.FormValue("moderation")
+	if !Found(moderationModes, mode) {
+		http.Error(w, "Unknown moderation mode "+mode, http.StatusBadRequest)
+		return
+	}
+
+	settings, err := spamSettingsFromForm(r)
+	if err != nil {
+		http.Error(w, "Invalid settings: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	settings[settingModeration] = mode
+
+	for key, value := range settings {
+		if err := s.store.SetSetting(key, value); err != nil {
+			http.Error(w, "Saving settings: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	http.Redirect(w, r, "/admin/comments", http.StatusSeeOther)
+}
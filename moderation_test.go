@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// the newest comment on the post
+func lastComment(t *testing.T, s *Server, postID string) Comment {
+	t.Helper()
+
+	comments, err := s.store.GetComments(postID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(comments) == 0 {
+		t.Fatal("no comments stored")
+	}
+	return comments[len(comments)-1]
+}
+
+func TestFirstTimeModeration(t *testing.T) {
+	s := newTestServer(t)
+	post := addTestPost(t, s, "Moderated", PostPublished, time.Now())
+
+	reader := newTestClient(t, s)
+	assertRedirect(t, reader.comment(post.Slug, "Reader", "my first comment", ""), http.StatusSeeOther, "/blog/moderated?comment=pending#comment-section")
+
+	first := lastComment(t, s, post.ID)
+	if first.Status != CommentPending || first.Commenter == "" {
+		t.Fatalf("first comment: got status %q, commenter %q, want a pending one with a key", first.Status, first.Commenter)
+	}
+
+	moderator := newTestClient(t, s)
+	moderator.login()
+	w := moderator.post("/admin/comments", url.Values{"action": {"approve"}, "comment": {first.ID}})
+	assertStatus(t, w, http.StatusOK)
+	assertBody(t, w, "1 marked approved")
+
+	// the same browser is trusted now
+	second := commentIDFromRedirect(t, reader.comment(post.Slug, "Reader", "my second comment", ""))
+	if comment, err := s.store.GetComment(second); err != nil || comment.Status != CommentApproved {
+		t.Fatalf("second comment: got %+v, error %v, want it approved", comment, err)
+	}
+
+	// another browser using the same name is not
+	impostor := newTestClient(t, s)
+	assertRedirect(t, impostor.comment(post.Slug, "Reader", "not really me", ""), http.StatusSeeOther, "/blog/moderated?comment=pending#comment-section")
+	if comment := lastComment(t, s, post.ID); comment.Status != CommentPending {
+		t.Fatalf("comment of another browser: got status %q, want %q", comment.Status, CommentPending)
+	}
+
+	// nor is a forged cookie
+	forger := newTestClient(t, s)
+	forger.cookies[commenterCookie] = &http.Cookie{Name: commenterCookie, Value: first.Commenter + ".forged"}
+	assertRedirect(t, forger.comment(post.Slug, "Reader", "forged key", ""), http.StatusSeeOther, "/blog/moderated?comment=pending#comment-section")
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Revision is a saved version of a post
+type Revision struct {
+	DatabaseID   primitive.ObjectID `bson:"_id"`
+	ID           string             `bson:"id"`
+	PostID       string             `bson:"postid"` // ID of the revised post
+	Saved        time.Time          `bson:"saved"`
+	Editor       string             `bson:"editor"`
+	Note         string             `bson:"note"` // created, edited, restored ...
+	Title        string             `bson:"title"`
+	Content      string             `bson:"content"`
+	ImageName    string             `bson:"imagename"`
+	BpTitle      string             `bson:"bptitle"`
+	BulletPoints []string           `bson:"bulletpoint"`
+	BqTitle      string             `bson:"bqtitle"`
+	BlogQuote    string             `bson:"blogquote"`
+	QuoteAuthor  string             `bson:"quoteauthor"`
+	VideoPath    string             `bson:"videopath"`
+	Format       string             `bson:"format"`
+}
+
+// snapshot of the revisable fields of post
+func newRevision(post NewPost, editor, note string) Revision {
+	database_ID := primitive.NewObjectID()
+
+	return Revision{
+		DatabaseID:   database_ID,
+		ID:           database_ID.Hex(),
+		PostID:       post.ID,
+		Saved:        time.Now(),
+		Editor:       editor,
+		Note:         note,
+		Title:        post.Title,
+		Content:      post.Content,
+		ImageName:    post.ImageName,
+		BpTitle:      post.BpTitle,
+		BulletPoints: post.BulletPoints,
+		BqTitle:      post.BqTitle,
+		BlogQuote:    post.BlogQuote,
+		QuoteAuthor:  post.QuoteAuthor,
+		VideoPath:    post.VideoPath,
+		Format:       post.Format,
+	}
+}
+
+// copies the revision back onto post
+func (rev Revision) apply(post *NewPost) {
+	post.Title = rev.Title
+	post.Content = rev.Content
+	post.ImageName = rev.ImageName
+	post.BpTitle = rev.BpTitle
+	post.BulletPoints = rev.BulletPoints
+	post.BqTitle = rev.BqTitle
+	post.BlogQuote = rev.BlogQuote
+	post.QuoteAuthor = rev.QuoteAuthor
+	post.VideoPath = rev.VideoPath
+	post.Format = rev.Format
+}
+
+// plain text form of the revision, one field per line, used for diffing
+func (rev Revision) Text() string {
+	var b strings.Builder
+
+	b.WriteString("Title: " + rev.Title + "\n")
+	b.WriteString("Image: " + rev.ImageName + "\n")
+	b.WriteString("Video: " + rev.VideoPath + "\n\n")
+	b.WriteString(rev.Content + "\n\n")
+
+	b.WriteString("Bullet points: " + rev.BpTitle + "\n")
+	for _, point := range rev.BulletPoints {
+		b.WriteString("- " + point + "\n")
+	}
+
+	b.WriteString("\nQuote: " + rev.BqTitle + "\n")
+	b.WriteString(rev.BlogQuote + "\n")
+	b.WriteString("-- " + rev.QuoteAuthor + "\n")
+
+	return b.String()
+}
+
+// name recorded as editor of a revision
+func editorName(r *http.Request) string {
+	return currentUser(r).Username
+}
+
+// records the current version of post, failures are only logged so they
+// never lose the edit itself
+func (s *Server) saveRevision(r *http.Request, post NewPost, note string) {
+	if err := s.store.InsertRevision(newRevision(post, editorName(r), note)); err != nil {
+		log.Println("Saving revision:", err)
+	}
+}
+
+// saves post as it is before its first edit. Posts written before
+// revisions existed have none, and the edit would lose their original text.
+func (s *Server) keepOriginal(post NewPost) {
+	revisions, err := s.store.GetRevisions(post.ID)
+	if err != nil || len(revisions) > 0 {
+		if err != nil {
+			log.Println("Finding revisions:", err)
+		}
+		return
+	}
+
+	author := ""
+	if user, err := s.store.GetUser(post.Author); err == nil {
+		author = user.Username
+	}
+
+	if err := s.store.InsertRevision(newRevision(post, author, "original")); err != nil {
+		log.Println("Saving revision:", err)
+	}
+}
+
+// DiffLine is a line of a line-level diff
+type DiffLine struct {
+	Op   string // "=" unchanged, "-" removed, "+" added
+	Text string
+}
+
+// most cells of the LCS table diffLines fills, about 8MB. Past it the
+// changed lines are shown as removed then added.
+const maxDiffCells = 1 << 20
+
+// line-level diff turning a into b, computed from the longest common
+// subsequence of lines
+func diffLines(a, b string) []DiffLine {
+	x, y := strings.Split(a, "\n"), strings.Split(b, "\n")
+
+	// lines in common at both ends need no table, most edits touch a few
+	// lines in the middle
+	head := 0
+	for head < len(x) && head < len(y) && x[head] == y[head] {
+		head++
+	}
+	tail := 0
+	for tail < len(x)-head && tail < len(y)-head && x[len(x)-1-tail] == y[len(y)-1-tail] {
+		tail++
+	}
+
+	var diff []DiffLine
+	for _, line := range x[:head] {
+		diff = append(diff, DiffLine{"=", line})
+	}
+	diff = append(diff, diffMiddle(x[head:len(x)-tail], y[head:len(y)-tail])...)
+	for _, line := range x[len(x)-tail:] {
+		diff = append(diff, DiffLine{"=", line})
+	}
+
+	return diff
+}
+
+// diff of the lines between the common head and tail
+func diffMiddle(x, y []string) []DiffLine {
+	var diff []DiffLine
+
+	if (len(x)+1)*(len(y)+1) > maxDiffCells {
+		for _, line := range x {
+			diff = append(diff, DiffLine{"-", line})
+		}
+		for _, line := range y {
+			diff = append(diff, DiffLine{"+", line})
+		}
+		return diff
+	}
+
+	// lcs[i][j] is the LCS length of x[i:] and y[j:]
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(x) && j < len(y) {
+		switch {
+		case x[i] == y[j]:
+			diff = append(diff, DiffLine{"=", x[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			diff = append(diff, DiffLine{"-", x[i]})
+			i++
+		default:
+			diff = append(diff, DiffLine{"+", y[j]})
+			j++
+		}
+	}
+	for ; i < len(x); i++ {
+		diff = append(diff, DiffLine{"-", x[i]})
+	}
+	for ; j < len(y); j++ {
+		diff = append(diff, DiffLine{"+", y[j]})
+	}
+
+	return diff
+}
+
+// data of the revision history page
+type RevisionsPage struct {
+	Post      NewPost
+	Revisions []Revision
+	From, To  string // IDs of the compared revisions
+	Diff      []DiffLine
+	Message   string
+}
+
+// lists the revisions of a post, compares two of them (?from=&to=) and
+// restores an older one (POST restore=ID)
+func (s *Server) PostRevisions(w http.ResponseWriter, r *http.Request) {
+	if !ValidMethod(r) {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := r.URL.Path[len("/admin/revisions/"):]
+
+	post, err := s.store.GetPost(id)
+	if err != nil {
+		if err == ErrNotFound {
+			templates(r).ExecuteTemplate(w, "page-end.html", nil)
+			return
+		}
+
+		http.Error(w, "Something went wrong: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !currentUser(r).CanEditPost(post) {
+		forbidden(w)
+		return
+	}
+
+	data := RevisionsPage{Post: post}
+
+	if r.Method == http.MethodPost {
+		restored, err := s.restoreRevision(r, post, r.FormValue("restore"))
+		if err != nil {
+			http.Error(w, "Restoring revision: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		data.Post, data.Message = restored, "Revision restored"
+	}
+
+	data.Revisions, err = s.store.GetRevisions(id)
+	if err != nil {
+		http.Error(w, "Finding revisions: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// compare two revisions
+	data.From, data.To = r.FormValue("from"), r.FormValue("to")
+	if data.From != "" && data.To != "" && r.Method == http.MethodGet {
+		from, err := s.getPostRevision(id, data.From)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		to, err := s.getPostRevision(id, data.To)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		data.Diff = diffLines(from.Text(), to.Text())
+	}
+
+	templates(r).ExecuteTemplate(w, "admin-revisions.html", data)
+}
+
+// makes revision revID the current version of post and records the restore
+// as a new revision
+func (s *Server) restoreRevision(r *http.Request, post NewPost, revID string) (NewPost, error) {
+	rev, err := s.getPostRevision(post.ID, revID)
+	if err != nil {
+		return NewPost{}, err
+	}
+
+	rev.apply(&post)
+	post.ReadTime = readTime(post.Title, post.Content)
+
+	if err := s.store.UpdatePost(post); err != nil {
+		return NewPost{}, err
+	}
+
+	s.saveRevision(r, post, "restored revision of "+rev.Saved.Local().Format(time.ANSIC))
+
+	return post, nil
+}
+
+// gets a revision making sure it belongs to the post
+func (s *Server) getPostRevision(postID, revID string) (Revision, error) {
+	rev, err := s.store.GetRevision(revID)
+	if err != nil && err != ErrNotFound {
+		return Revision{}, err
+	}
+
+	if err == ErrNotFound || rev.PostID != postID {
+		return Revision{}, errors.New("unknown revision " + revID)
+	}
+
+	return rev, nil
+}
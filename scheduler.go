@@ -0,0 +1,42 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// publishes due scheduled posts and deletes unconfirmed subscribers every
+// interval, runs until the process exits
+func (s *Server) runScheduler(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		now := time.Now()
+		s.publishDuePosts(now)
+		s.expireSubscribers(now)
+		<-ticker.C
+	}
+}
+
+// makes scheduled posts whose publish time is before now visible and mails
+// the subscribers about them
+func (s *Server) publishDuePosts(now time.Time) {
+	posts, err := s.store.GetDuePosts(now)
+	if err != nil {
+		log.Println("Getting scheduled posts:", err)
+		return
+	}
+
+	for _, post := range posts {
+		post.Status = PostPublished
+
+		if err := s.store.UpdatePost(post); err != nil {
+			log.Println("Publishing scheduled post:", err)
+			continue
+		}
+
+		log.Println("Published scheduled post", post.ID)
+		s.notifySubscribers(post)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// latin letters with diacritics and ligatures spelled in plain ascii
+var transliterations = map[rune]string{
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'ä': "a", 'å': "a", 'ā': "a", 'ă': "a", 'ą': "a",
+	'æ': "ae", 'ç': "c", 'ć': "c", 'ĉ': "c", 'ċ': "c", 'č': "c", 'ď': "d", 'đ': "d", 'ð': "d",
+	'è': "e", 'é': "e", 'ê': "e", 'ë': "e", 'ē': "e", 'ĕ': "e", 'ė': "e", 'ę': "e", 'ě': "e",
+	'ĝ': "g", 'ğ': "g", 'ġ': "g", 'ģ': "g", 'ĥ': "h", 'ħ': "h",
+	'ì': "i", 'í': "i", 'î': "i", 'ï': "i", 'ĩ': "i", 'ī': "i", 'ĭ': "i", 'į': "i", 'ı': "i",
+	'ĵ': "j", 'ķ': "k", 'ĺ': "l", 'ļ': "l", 'ľ': "l", 'ŀ': "l", 'ł': "l",
+	'ñ': "n", 'ń': "n", 'ņ': "n", 'ň': "n",
+	'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o", 'ö': "o", 'ø': "o", 'ō': "o", 'ŏ': "o", 'ő': "o", 'œ': "oe",
+	'ŕ': "r", 'ŗ': "r", 'ř': "r", 'ś': "s", 'ŝ': "s", 'ş': "s", 'š': "s", 'ș': "s", 'ß': "ss",
+	'ţ': "t", 'ť': "t", 'ŧ': "t", 'ț': "t", 'þ': "th",
+	'ù': "u", 'ú': "u", 'û': "u", 'ü': "u", 'ũ': "u", 'ū': "u", 'ŭ': "u", 'ů': "u", 'ű': "u", 'ų': "u",
+	'ŵ': "w", 'ý': "y", 'ÿ': "y", 'ŷ': "y", 'ź': "z", 'ż': "z", 'ž': "z",
+	'&': "and",
+}
+
+// longest slug generated from a title
+const maxSlugLength = 80
+
+// turns a title into a url path segment: lower case ascii letters and digits
+// separated by single dashes
+func slugify(title string) string {
+	var b strings.Builder
+	dash := false
+
+	for _, r := range strings.ToLower(title) {
+		if t, ok := transliterations[r]; ok {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteString(t)
+			dash = false
+			continue
+		}
+
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+			continue
+		}
+
+		// anything else separates words
+		dash = true
+	}
+
+	slug := b.String()
+	if len(slug) > maxSlugLength {
+		slug = strings.TrimRight(slug[:maxSlugLength], "-")
+	}
+
+	return slug
+}
+
+// sets the slug of post to the one given in the form, or one made from the
+// title, numbered if another post uses it now or used it before, its old
+// links must keep working
+func (s *Server) assignSlug(post *NewPost) error {
+	base := post.Slug
+	if base == "" {
+		base = slugify(post.Title)
+	}
+	if base == "" { // nothing usable in the title
+		base = post.ID
+	}
+
+	slug := base
+	for n := 2; ; n++ {
+		taken, err := s.slugTaken(slug, post.ID)
+		if err != nil {
+			return err
+		}
+
+		if !taken {
+			post.Slug = slug
+			return nil
+		}
+
+		slug = base + "-" + strconv.Itoa(n)
+	}
+}
+
+// reports if a post other than the one with ID has slug, or had it before
+func (s *Server) slugTaken(slug, ID string) (bool, error) {
+	for _, find := range []func(string) (NewPost, error){s.store.GetPostBySlug, s.store.GetPostByOldSlug} {
+		other, err := find(slug)
+		if err == nil && other.ID != ID {
+			return true, nil
+		}
+		if err != nil && err != ErrNotFound {
+			return false, err
+		}
+	}
+
+	return false, nil
+}
+
+// remembers the slug a published post had before the edit, links to it
+// are out in mails and on other sites
+func (s *Server) keepOldSlug(post, edited NewPost) error {
+	if post.Slug == "" || post.Slug == edited.Slug || !post.IsPublished() {
+		return nil
+	}
+
+	return s.store.AddOldSlug(post.Slug, post.ID)
+}
+
+// gives posts stored before slugs existed a slug, returns how many were updated
+func backfillSlugs(store Store) (int, error) {
+	s := &Server{store: store}
+
+	posts, err := store.GetPosts(PostFilter{}, 0, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	// oldest first so the first post with a title gets the plain slug
+	updated := 0
+	for i := len(posts) - 1; i >= 0; i-- {
+		post := posts[i]
+		if post.Slug != "" {
+			continue
+		}
+
+		if err := s.assignSlug(&post); err != nil {
+			return updated, err
+		}
+
+		if err := store.UpdatePost(post); err != nil {
+			return updated, err
+		}
+
+		log.Printf("Post %s is now at /blog/%s\n", post.ID, post.Slug)
+		updated++
+	}
+
+	return updated, nil
+}
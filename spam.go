@@ -0,0 +1,527 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"html/template"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Submission is a new comment checked by the spam filter
+type Submission struct {
+	Name     string
+	Text     string
+	Addr     string        // client address
+	Honeypot string        // hidden field only bots fill in
+	Elapsed  time.Duration // between rendering the form and posting it, -1 if unknown
+}
+
+// SpamCheck is a test of the spam filter. It scores a submission from 0
+// (clean) to 1 (certainly spam) and says why when the score is not 0.
+type SpamCheck interface {
+	Check(sub Submission, conf SpamConfig) (score float64, reason string, err error)
+}
+
+// SpamCheckFunc lets a function be used as a SpamCheck
+type SpamCheckFunc func(sub Submission, conf SpamConfig) (float64, string, error)
+
+func (f SpamCheckFunc) Check(sub Submission, conf SpamConfig) (float64, string, error) {
+	return f(sub, conf)
+}
+
+// checks run on every submission, the highest score decides
+func defaultSpamChecks(classifier *spamClassifier) []SpamCheck {
+	return []SpamCheck{
+		SpamCheckFunc(checkHoneypot),
+		SpamCheckFunc(checkFillTime),
+		SpamCheckFunc(checkLinks),
+		SpamCheckFunc(checkBlockedWords),
+		SpamCheckFunc(checkBlockedAddr),
+		classifier,
+	}
+}
+
+// submissions scoring at least spamModerateScore wait for a moderator
+// whatever the moderation mode, those scoring at least spamRejectScore go
+// straight to spam
+const (
+	spamModerateScore = 0.5
+	spamRejectScore   = 0.9
+)
+
+// SpamConfig is the spam filter settings of the site
+type SpamConfig struct {
+	MinFillTime     time.Duration // people take longer to write a comment
+	MaxLinks        int
+	BlockedWords    []string      // lowercase
+	BlockedAddrs    []string      // addresses or CIDR ranges
+	DuplicateWindow time.Duration // how long the same comment is refused, 0 for ever
+}
+
+// whole seconds of MinFillTime, for the settings form
+func (c SpamConfig) MinFillSeconds() int {
+	return int(c.MinFillTime / time.Second)
+}
+
+// whole hours of DuplicateWindow, for the settings form
+func (c SpamConfig) DuplicateHours() int {
+	return int(c.DuplicateWindow / time.Hour)
+}
+
+// spam filter settings, lists are stored one item per line
+const (
+	settingSpamMinFill     = "spam-min-fill-seconds"
+	settingSpamMaxLinks    = "spam-max-links"
+	settingSpamWords       = "spam-blocked-words"
+	settingSpamAddrs       = "spam-blocked-addrs"
+	settingDuplicateWindow = "duplicate-window-hours"
+)
+
+// current spam filter settings of the site
+func loadSpamConfig(store Store) (SpamConfig, error) {
+	conf := SpamConfig{MinFillTime: 3 * time.Second, MaxLinks: 2, DuplicateWindow: 24 * time.Hour}
+
+	values := map[string]string{}
+	for _, key := range []string{settingSpamMinFill, settingSpamMaxLinks, settingSpamWords, settingSpamAddrs, settingDuplicateWindow} {
+		value, err := store.GetSetting(key)
+		if err != nil && err != ErrNotFound {
+			return SpamConfig{}, err
+		}
+		values[key] = value
+	}
+
+	if seconds, err := strconv.Atoi(values[settingSpamMinFill]); err == nil && seconds >= 0 {
+		conf.MinFillTime = time.Duration(seconds) * time.Second
+	}
+
+	if links, err := strconv.Atoi(values[settingSpamMaxLinks]); err == nil && links >= 0 {
+		conf.MaxLinks = links
+	}
+
+	if hours, err := strconv.Atoi(values[settingDuplicateWindow]); err == nil && hours >= 0 {
+		conf.DuplicateWindow = time.Duration(hours) * time.Hour
+	}
+
+	conf.BlockedWords = settingLines(strings.ToLower(values[settingSpamWords]))
+	conf.BlockedAddrs = settingLines(values[settingSpamAddrs])
+
+	return conf, nil
+}
+
+// non-empty trimmed lines of a list setting
+func settingLines(value string) []string {
+	var lines []string
+	for _, line := range strings.Split(value, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// spam settings of the settings form, validated
+func spamSettingsFromForm(r *http.Request) (map[string]string, error) {
+	seconds, err := strconv.Atoi(r.FormValue("min_fill_seconds"))
+	if err != nil || seconds < 0 {
+		return nil, errors.New("the minimum fill time is a number of seconds")
+	}
+
+	links, err := strconv.Atoi(r.FormValue("max_links"))
+	if err != nil || links < 0 {
+		return nil, errors.New("the number of links allowed is a number")
+	}
+
+	hours, err := strconv.Atoi(r.FormValue("duplicate_hours"))
+	if err != nil || hours < 0 {
+		return nil, errors.New("the duplicate window is a number of hours")
+	}
+
+	addrs := settingLines(r.FormValue("blocked_addrs"))
+	for _, addr := range addrs {
+		if net.ParseIP(addr) == nil {
+			if _, _, err := net.ParseCIDR(addr); err != nil {
+				return nil, errors.New(addr + " is not an address or CIDR range")
+			}
+		}
+	}
+
+	return map[string]string{
+		settingSpamMinFill:     strconv.Itoa(seconds),
+		settingSpamMaxLinks:    strconv.Itoa(links),
+		settingSpamWords:       strings.Join(settingLines(r.FormValue("blocked_words")), "\n"),
+		settingSpamAddrs:       strings.Join(addrs, "\n"),
+		settingDuplicateWindow: strconv.Itoa(hours),
+	}, nil
+}
+
+// errDuplicateComment is returned for a comment posted again
+var errDuplicateComment = errors.New("you already made this comment")
+
+// hash of a comment by name, the same for the same words whatever
+// their case and spacing. Stores index it to find duplicates.
+func contentHash(name, text string) string {
+	normalize := func(s string) string {
+		return strings.Join(strings.Fields(strings.ToLower(s)), " ")
+	}
+
+	sum := sha256.Sum256([]byte(normalize(name) + "\x00" + normalize(text)))
+	return hex.EncodeToString(sum[:])
+}
+
+// gives comments stored before content hashes existed theirs, so reposting
+// them counts as a duplicate. Returns how many were updated.
+func backfillContentHashes(store Store) (int, error) {
+	posts, err := store.GetPosts(PostFilter{}, 0, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	updated := 0
+	for _, post := range posts {
+		comments, err := store.GetComments(post.ID)
+		if err != nil {
+			return updated, err
+		}
+
+		for _, comment := range comments {
+			if comment.ContentHash != "" {
+				continue
+			}
+
+			if err := store.SetCommentHash(comment.ID, contentHash(comment.Commentor, comment.Comment)); err != nil {
+				return updated, err
+			}
+			updated++
+		}
+	}
+
+	if updated > 0 {
+		log.Println("Content hashes given to", updated, "comment(s)")
+	}
+
+	return updated, nil
+}
+
+// oldest comments a new one is compared with, zero for all
+func (s *Server) duplicateSince() (time.Time, error) {
+	conf, err := loadSpamConfig(s.store)
+	if err != nil || conf.DuplicateWindow == 0 {
+		return time.Time{}, err
+	}
+
+	return time.Now().Add(-conf.DuplicateWindow), nil
+}
+
+// SpamResult is what the spam checks found in a submission
+type SpamResult struct {
+	Score   float64 // highest score of the checks
+	Reasons []string
+}
+
+// summary kept with the comment for moderators, empty when no check scored
+func (res SpamResult) Report() string {
+	if len(res.Reasons) == 0 {
+		return ""
+	}
+	return strconv.FormatFloat(res.Score, 'f', 2, 64) + ": " + strings.Join(res.Reasons, ", ")
+}
+
+// runs the spam checks of the server on sub
+func (s *Server) checkSpam(sub Submission) (SpamResult, error) {
+	conf, err := loadSpamConfig(s.store)
+	if err != nil {
+		return SpamResult{}, err
+	}
+
+	var result SpamResult
+	for _, check := range s.spamChecks {
+		score, reason, err := check.Check(sub, conf)
+		if err != nil {
+			return SpamResult{}, err
+		}
+
+		if score > result.Score {
+			result.Score = score
+		}
+
+		if reason != "" {
+			result.Reasons = append(result.Reasons, reason)
+		}
+	}
+
+	return result, nil
+}
+
+// moderation status and spam report of a comment by name posted
+// with r. The spam filter holds back or rejects what it suspects, the rest
+// follows the moderation mode.
+func (s *Server) screenSubmission(r *http.Request, comment Comment) (status, report string, err error) {
+	sub := Submission{
+		Name:     comment.Commentor,
+		Text:     comment.Comment,
+		Addr:     clientAddr(r),
+		Honeypot: r.FormValue(honeypotField),
+		Elapsed:  s.formElapsed(r.FormValue(formStampField)),
+	}
+
+	result, err := s.checkSpam(sub)
+	if err != nil {
+		return "", "", err
+	}
+	report = result.Report()
+
+	switch {
+	case result.Score >= spamRejectScore:
+		log.Println("Spam from", sub.Addr, report)
+		return CommentSpam, report, nil
+	case result.Score >= spamModerateScore:
+		return CommentPending, report, nil
+	}
+
+	status, err = s.moderationStatus(comment.Commenter)
+	return status, report, err
+}
+
+// fields the comment forms carry for the spam filter
+const (
+	honeypotField  = "website"
+	formStampField = "form_stamp"
+)
+
+// hidden fields of the comment forms: a honeypot and when the form was
+// rendered
+func (s *Server) spamFields() template.HTML {
+	return template.HTML(`<div style="display: none" aria-hidden="true"><input type="text" name="` + honeypotField + `" tabindex="-1" autocomplete="off"></div>` +
+		`<input type="hidden" name="` + formStampField + `" value="` + s.formStamp(time.Now()) + `">`)
+}
+
+// when a form was rendered, signed so bots cannot backdate it
+func (s *Server) formStamp(now time.Time) string {
+	unix := strconv.FormatInt(now.Unix(), 10)
+	return unix + "." + s.sign("form:"+unix)
+}
+
+// time since stamp was made, -1 if it is missing or forged
+func (s *Server) formElapsed(stamp string) time.Duration {
+	parts := strings.SplitN(stamp, ".", 2)
+	if len(parts) != 2 || !hmac.Equal([]byte(s.sign("form:"+parts[0])), []byte(parts[1])) {
+		return -1
+	}
+
+	unix, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return -1
+	}
+
+	return time.Since(time.Unix(unix, 0))
+}
+
+// people never see the honeypot field
+func checkHoneypot(sub Submission, conf SpamConfig) (float64, string, error) {
+	if sub.Honeypot != "" {
+		return 1, "hidden field filled in", nil
+	}
+	return 0, "", nil
+}
+
+func checkFillTime(sub Submission, conf SpamConfig) (float64, string, error) {
+	if sub.Elapsed < 0 {
+		return 0.6, "form not loaded from the blog", nil
+	}
+
+	if sub.Elapsed < conf.MinFillTime {
+		return 1, "form filled in " + sub.Elapsed.Round(time.Second).String(), nil
+	}
+
+	return 0, "", nil
+}
+
+var linkExp = regexp.MustCompile(`(?i)https?://\S+|www\.\S+`)
+
+func checkLinks(sub Submission, conf SpamConfig) (float64, string, error) {
+	links := len(linkExp.FindAllStringIndex(sub.Text, -1))
+	if links > conf.MaxLinks {
+		return 0.7, strconv.Itoa(links) + " links", nil
+	}
+	return 0, "", nil
+}
+
+func checkBlockedWords(sub Submission, conf SpamConfig) (float64, string, error) {
+	content := strings.ToLower(sub.Name + " " + sub.Text)
+	for _, word := range conf.BlockedWords {
+		if strings.Contains(content, word) {
+			return 1, `blocked word "` + word + `"`, nil
+		}
+	}
+	return 0, "", nil
+}
+
+func checkBlockedAddr(sub Submission, conf SpamConfig) (float64, string, error) {
+	ip := net.ParseIP(sub.Addr)
+	if ip == nil {
+		return 0, "", nil
+	}
+
+	for _, addr := range conf.BlockedAddrs {
+		blocked := false
+		if _, network, err := net.ParseCIDR(addr); err == nil {
+			blocked = network.Contains(ip)
+		} else {
+			blocked = ip.Equal(net.ParseIP(addr))
+		}
+
+		if blocked {
+			return 1, "blocked address " + sub.Addr, nil
+		}
+	}
+
+	return 0, "", nil
+}
+
+// SpamToken is a word and the number of spam and approved (ham) messages it
+// was seen in
+type SpamToken struct {
+	Token string `bson:"_id"`
+	Spam  int    `bson:"spam"`
+	Ham   int    `bson:"ham"`
+}
+
+// what the classifier learnt from a message
+const (
+	classSpam = "spam"
+	classHam  = "ham"
+)
+
+const (
+	// counts the trained messages, tokens never contain *
+	spamMessagesToken = "*messages*"
+
+	// messages of each class needed before the classifier scores anything
+	spamMinTrained = 5
+
+	// tokens furthest from neutral that decide the score
+	spamDecidingTokens = 15
+)
+
+// spamClassifier is a naive Bayes classifier trained from the approve and
+// spam decisions of moderators
+type spamClassifier struct {
+	store Store
+}
+
+// lowercase words of a message, each once
+func spamTokens(name, text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(name+" "+text), func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+	})
+
+	seen := map[string]bool{}
+	var tokens []string
+	for _, word := range words {
+		if len(word) < 3 || len(word) > 30 || seen[word] {
+			continue
+		}
+
+		seen[word] = true
+		tokens = append(tokens, word)
+	}
+
+	return tokens
+}
+
+func (c *spamClassifier) Check(sub Submission, conf SpamConfig) (float64, string, error) {
+	tokens := spamTokens(sub.Name, sub.Text)
+
+	counts, err := c.store.GetSpamTokens(append(tokens, spamMessagesToken))
+	if err != nil {
+		return 0, "", err
+	}
+
+	messages := counts[spamMessagesToken]
+	if messages.Spam < spamMinTrained || messages.Ham < spamMinTrained {
+		return 0, "", nil
+	}
+
+	var probs []float64
+	for _, token := range tokens {
+		count, ok := counts[token]
+		if !ok || count.Spam+count.Ham == 0 {
+			continue
+		}
+
+		spam := float64(count.Spam) / float64(messages.Spam)
+		ham := float64(count.Ham) / float64(messages.Ham)
+
+		// Robinson's correction keeps rarely seen tokens near neutral
+		n := float64(count.Spam + count.Ham)
+		p := (0.5 + n*spam/(spam+ham)) / (1 + n)
+
+		if math.Abs(p-0.5) >= 0.1 {
+			probs = append(probs, math.Min(0.99, math.Max(0.01, p)))
+		}
+	}
+
+	if len(probs) == 0 {
+		return 0, "", nil
+	}
+
+	sort.Slice(probs, func(i, j int) bool {
+		return math.Abs(probs[i]-0.5) > math.Abs(probs[j]-0.5)
+	})
+	if len(probs) > spamDecidingTokens {
+		probs = probs[:spamDecidingTokens]
+	}
+
+	var spamLog, hamLog float64
+	for _, p := range probs {
+		spamLog += math.Log(p)
+		hamLog += math.Log(1 - p)
+	}
+
+	score := 1 / (1 + math.Exp(hamLog-spamLog))
+	if score < spamModerateScore {
+		return score, "", nil
+	}
+
+	return score, "classifier " + strconv.FormatFloat(score, 'f', 2, 64), nil
+}
+
+// changes what the classifier learnt from a message from class from to
+// class to, either may be empty for nothing
+func (c *spamClassifier) retrain(name, text, from, to string) error {
+	if from == to {
+		return nil
+	}
+
+	tokens := append(spamTokens(name, text), spamMessagesToken)
+
+	if from != "" {
+		if err := c.train(tokens, from, -1); err != nil {
+			return err
+		}
+	}
+
+	if to != "" {
+		return c.train(tokens, to, 1)
+	}
+
+	return nil
+}
+
+func (c *spamClassifier) train(tokens []string, class string, weight int) error {
+	if class == classSpam {
+		return c.store.AddSpamTokens(tokens, weight, 0)
+	}
+	return c.store.AddSpamTokens(tokens, 0, weight)
+}
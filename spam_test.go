@@ -0,0 +1,248 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestSpamChecks(t *testing.T) {
+	conf := SpamConfig{MinFillTime: 3 * time.Second, MaxLinks: 2, BlockedWords: []string{"casino"}, BlockedAddrs: []string{"203.0.113.7", "198.51.100.0/24"}}
+	clean := Submission{Name: "Reader", Text: "Nice post", Addr: "192.0.2.1", Elapsed: time.Minute}
+
+	tests := []struct {
+		name  string
+		check SpamCheckFunc
+		sub   func(sub *Submission)
+		score float64
+	}{
+		{"honeypot empty", checkHoneypot, func(sub *Submission) {}, 0},
+		{"honeypot filled", checkHoneypot, func(sub *Submission) { sub.Honeypot = "http://spam.example" }, 1},
+		{"filled in slowly", checkFillTime, func(sub *Submission) {}, 0},
+		{"filled in too fast", checkFillTime, func(sub *Submission) { sub.Elapsed = time.Second }, 1},
+		{"form not from the blog", checkFillTime, func(sub *Submission) { sub.Elapsed = -1 }, 0.6},
+		{"links allowed", checkLinks, func(sub *Submission) { sub.Text = "see https://a.example and www.b.example" }, 0},
+		{"too many links", checkLinks, func(sub *Submission) { sub.Text = "http://a.example http://b.example www.c.example" }, 0.7},
+		{"no blocked word", checkBlockedWords, func(sub *Submission) {}, 0},
+		{"blocked word in text", checkBlockedWords, func(sub *Submission) { sub.Text = "Best CASINO online" }, 1},
+		{"blocked word in name", checkBlockedWords, func(sub *Submission) { sub.Name = "casino king" }, 1},
+		{"address allowed", checkBlockedAddr, func(sub *Submission) {}, 0},
+		{"address blocked", checkBlockedAddr, func(sub *Submission) { sub.Addr = "203.0.113.7" }, 1},
+		{"address in blocked range", checkBlockedAddr, func(sub *Submission) { sub.Addr = "198.51.100.42" }, 1},
+	}
+
+	for _, test := range tests {
+		sub := clean
+		test.sub(&sub)
+
+		score, reason, err := test.check(sub, conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if score != test.score {
+			t.Errorf("%s: got score %v, want %v", test.name, score, test.score)
+		}
+		if (score > 0) != (reason != "") {
+			t.Errorf("%s: got reason %q with score %v", test.name, reason, score)
+		}
+	}
+}
+
+func TestScreenSubmission(t *testing.T) {
+	s := newTestServer(t)
+	if err := s.store.SetSetting(settingModeration, ModerateNone); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		score  float64
+		status string
+	}{
+		{1, CommentSpam},
+		{spamRejectScore, CommentSpam},
+		{0.89, CommentPending},
+		{spamModerateScore, CommentPending},
+		{0.49, CommentApproved}, // left to the moderation mode
+		{0, CommentApproved},
+	}
+
+	for _, test := range tests {
+		score := test.score
+		s.spamChecks = []SpamCheck{SpamCheckFunc(func(sub Submission, conf SpamConfig) (float64, string, error) {
+			if score == 0 {
+				return 0, "", nil
+			}
+			return score, "test", nil
+		})}
+
+		r := httptest.NewRequest("POST", "/blog/post", nil)
+		status, report, err := s.screenSubmission(r, Comment{Commentor: "Reader", Comment: "Nice post"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != test.status {
+			t.Errorf("score %v: got %s, want %s", test.score, status, test.status)
+		}
+		if (score > 0) != (report != "") {
+			t.Errorf("score %v: got report %q", test.score, report)
+		}
+	}
+}
+
+func TestScreenSubmissionForm(t *testing.T) {
+	s := newTestServer(t)
+	if err := s.store.SetSetting(settingModeration, ModerateNone); err != nil {
+		t.Fatal(err)
+	}
+
+	comment := Comment{Commentor: "Reader", Comment: "Nice post"}
+	screen := func(form url.Values) string {
+		r := httptest.NewRequest("POST", "/blog/post", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		status, _, err := s.screenSubmission(r, comment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return status
+	}
+
+	old := s.formStamp(time.Now().Add(-time.Minute))
+	if status := screen(url.Values{formStampField: {old}}); status != CommentApproved {
+		t.Errorf("form of a minute ago: got %s, want %s", status, CommentApproved)
+	}
+	if status := screen(url.Values{formStampField: {s.formStamp(time.Now())}}); status != CommentSpam {
+		t.Errorf("form posted at once: got %s, want %s", status, CommentSpam)
+	}
+	if status := screen(url.Values{formStampField: {old}, honeypotField: {"x"}}); status != CommentSpam {
+		t.Errorf("honeypot filled in: got %s, want %s", status, CommentSpam)
+	}
+
+	// a stamp cannot be backdated without the key
+	forged := strings.SplitN(old, ".", 2)[0] + ".forged"
+	if status := screen(url.Values{formStampField: {forged}}); status != CommentPending {
+		t.Errorf("forged stamp: got %s, want %s", status, CommentPending)
+	}
+}
+
+func TestSpamClassifier(t *testing.T) {
+	store := newMemoryStore()
+	classifier := &spamClassifier{store: store}
+
+	spam := "buy cheap pills online now"
+	ham := "thanks for the clear explanation of goroutines"
+
+	// untrained, it has no opinion
+	if score, _, err := classifier.Check(Submission{Text: spam}, SpamConfig{}); err != nil || score != 0 {
+		t.Fatalf("untrained: got score %v, error %v, want 0", score, err)
+	}
+
+	for i := 0; i < spamMinTrained; i++ {
+		if err := classifier.retrain("bot", spam, "", classSpam); err != nil {
+			t.Fatal(err)
+		}
+		if err := classifier.retrain("reader", ham, "", classHam); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	score, reason, err := classifier.Check(Submission{Name: "bot", Text: "cheap pills, buy now"}, SpamConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if score < spamRejectScore || reason == "" {
+		t.Errorf("spam: got score %v, reason %q, want at least %v", score, reason, spamRejectScore)
+	}
+
+	score, reason, err = classifier.Check(Submission{Name: "reader", Text: "clear explanation, thanks"}, SpamConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if score >= spamModerateScore || reason != "" {
+		t.Errorf("ham: got score %v, reason %q, want under %v", score, reason, spamModerateScore)
+	}
+}
+
+func TestModerationRetrains(t *testing.T) {
+	s := newTestServer(t)
+
+	comment := Comment{DatabaseID: primitive.NewObjectID(), ID: "c1", BelongsTo: "p1", Commentor: "bot", Comment: "cheap pills", Status: CommentPending}
+	if err := s.store.InsertComment(comment); err != nil {
+		t.Fatal(err)
+	}
+
+	// what the classifier knows of the comment after each decision
+	steps := []struct {
+		action  string
+		trained string
+		spam    int
+		ham     int
+	}{
+		{"spam", classSpam, 1, 0},
+		{"approve", classHam, 0, 1},
+		{"approve", classHam, 0, 1}, // not counted twice
+		{"reject", "", 0, 0},
+		{"spam", classSpam, 1, 0},
+	}
+
+	for _, step := range steps {
+		if _, err := s.moderate(step.action, []string{comment.ID}); err != nil {
+			t.Fatal(err)
+		}
+
+		stored, err := s.store.GetComment(comment.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Trained != step.trained {
+			t.Errorf("after %s: trained %q, want %q", step.action, stored.Trained, step.trained)
+		}
+
+		counts, err := s.store.GetSpamTokens([]string{"pills", spamMessagesToken})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, token := range []string{"pills", spamMessagesToken} {
+			if counts[token].Spam != step.spam || counts[token].Ham != step.ham {
+				t.Errorf("after %s: %s counted %+v, want spam %d ham %d", step.action, token, counts[token], step.spam, step.ham)
+			}
+		}
+	}
+}
+
+func TestBackfillContentHashes(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		post := NewPost{DatabaseID: primitive.NewObjectID(), ID: "p1", Title: "Post", Slug: "post", Status: PostPublished}
+		if err := store.InsertPost(post); err != nil {
+			t.Fatal(err)
+		}
+
+		// stored before content hashes existed
+		old := Comment{DatabaseID: primitive.NewObjectID(), ID: "c1", BelongsTo: post.ID, Commentor: "Reader", Comment: "Nice  post", Status: CommentApproved}
+		if err := store.InsertComment(old); err != nil {
+			t.Fatal(err)
+		}
+
+		hash := contentHash("reader", "nice post")
+		if found, err := store.HasDuplicateComment(post.ID, "", hash, time.Time{}); err != nil || found {
+			t.Fatalf("before the backfill: got %v, error %v, want no duplicate", found, err)
+		}
+
+		if _, err := migrateStore(store); err != nil {
+			t.Fatal(err)
+		}
+
+		if found, err := store.HasDuplicateComment(post.ID, "", hash, time.Time{}); err != nil || !found {
+			t.Fatalf("after the backfill: got %v, error %v, want a duplicate", found, err)
+		}
+
+		// nothing left to do the next time
+		if updated, err := backfillContentHashes(store); err != nil || updated != 0 {
+			t.Fatalf("second backfill: updated %d, error %v, want 0", updated, err)
+		}
+	})
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// ErrNotFound is returned by a Store when a requested document does not exist
+var ErrNotFound = errors.New("not found")
+
+// migrator is implemented by stores with a versioned schema
+type migrator interface {
+	// applies pending schema migrations and returns how many were applied
+	Migrate() (int, error)
+}
+
+// opens the store selected by the storageBackend environment variable,
+// "mongo" (default), "sqlite" or "memory"
+func openStore() (Store, error) {
+	switch backend := os.Getenv("storageBackend"); backend {
+	case "", "mongo":
+		// shellURI := "mongodb://localhost:27017"
+		return newMongoStore(os.Getenv("atlasURI"))
+	case "sqlite":
+		path := os.Getenv("sqlitePath")
+		if path == "" {
+			path = "myblog.db"
+		}
+		return newSQLiteStore(path)
+	case "memory":
+		return newMemoryStore(), nil
+	default:
+		return nil, errors.New("unknown storage backend " + backend)
+	}
+}
+
+// PostFilter narrows down the posts returned by Store.GetPosts
+type PostFilter struct {
+	PublishedOnly bool   // hide drafts and scheduled posts
+	Tag           string // only posts with this tag
+	Category      string // only posts in this category
+	Author        string // only posts written by this User.ID
+}
+
+// reports if post passes the filter
+func (f PostFilter) Match(post NewPost) bool {
+	if f.PublishedOnly && !post.IsPublished() {
+		return false
+	}
+
+	if f.Tag != "" && !Found(post.Tags, f.Tag) {
+		return false
+	}
+
+	if f.Author != "" && post.Author != f.Author {
+		return false
+	}
+
+	return f.Category == "" || post.Category == f.Category
+}
+
+// TagCount is a tag and the number of published posts using it
+type TagCount struct {
+	Name  string `bson:"_id"`
+	Count int    `bson:"count"`
+	Size  int    `bson:"-"` // font size in the tag cloud, set by the server
+}
+
+// DeletedPost reports what a cascading post delete removed
+type DeletedPost struct {
+	Post      NewPost
+	Comments  int // number of comments starting a thread removed
+	Replies   int // number of replies removed, at any depth
+	Revisions int // number of revisions removed
+	Images    []string
+	Done      bool
+}
+
+// Store is the persistence layer used by the http handlers. Every backend
+// (MongoDB, in memory, ...) implements it so handlers never talk to a
+// particular database directly.
+type Store interface {
+	// posts, sorted by published date (newest first). Deleting a post also
+	// deletes its comments and the post revisions.
+	GetPosts(filter PostFilter, skip, limit int64) ([]NewPost, error)
+	GetDuePosts(now time.Time) ([]NewPost, error) // scheduled posts published before now
+	GetPost(ID string) (NewPost, error)
+	GetPostBySlug(slug string) (NewPost, error)
+	GetPostByOldSlug(slug string) (NewPost, error) // post that had slug before it was renamed
+	AddOldSlug(slug, postID string) error          // takes slug from any post that had it before
+	InsertPost(post NewPost) error
+	UpdatePost(post NewPost) error // replaces the post with the same ID
+	DeletePost(ID string) (DeletedPost, error)
+	GetTags() ([]TagCount, error) // tags of published posts, sorted by name
+
+	// saved versions of a post, newest first
+	GetRevisions(postID string) ([]Revision, error)
+	GetRevision(ID string) (Revision, error)
+	InsertRevision(rev Revision) error
+
+	// comments of a blog post and the replies to them at every depth, oldest
+	// first, whatever their moderation status
+	GetComments(postID string) ([]Comment, error)
+	GetComment(ID string) (Comment, error)
+
+	// number of comments readers see on each of the posts, approved ones
+	// with every comment above them approved. Posts without any are left
+	// out.
+	CountComments(postIDs []string) (map[string]int, error)
+
+	GetCommentsByStatus(status string) ([]Comment, error) // approved includes those without a status
+	InsertComment(comment Comment) error
+	SetCommentStatus(ID, status, trained string) error // trained is Comment.Trained
+	SetCommentHash(ID, hash string) error              // Comment.ContentHash, see backfillContentHashes
+	DeleteComment(ID string) error                     // also deletes the replies to it, at every depth
+
+	// reports if the post has a comment replying to parentID (empty for
+	// none) with Comment.ContentHash hash stored after since, a zero since
+	// means at any time
+	HasDuplicateComment(postID, parentID, hash string, since time.Time) (bool, error)
+
+	// reports if the browser with the commenter key, see commenterKey, has
+	// an approved comment. An empty key has none.
+	IsApprovedCommenter(key string) (bool, error)
+
+	// word counts of the spam classifier, tokens never seen are left out
+	GetSpamTokens(tokens []string) (map[string]SpamToken, error)
+	AddSpamTokens(tokens []string, spam, ham int) error // counts never drop below zero
+
+	// mailing list. GetSubscribers only returns active subscribers, the
+	// others return them whatever their status.
+	GetSubscribers() ([]Subscriber, error)
+	GetSubscriberByMail(mail string) (Subscriber, error)
+	GetSubscriberByToken(token string) (Subscriber, error) // an empty token matches nobody
+	InsertSubscriber(subscriber Subscriber) error
+	ConfirmSubscriber(ID string) error     // makes a pending subscriber active
+	UpdateSubscriber(sub Subscriber) error // replaces the subscriber with the same ID
+	DeleteSubscriber(ID string) error
+	ExpireSubscribers(before time.Time) (int, error) // deletes those still pending that were created before, returns how many
+
+	// outgoing mail queue. ClaimMailJobs marks up to limit jobs that are
+	// due at now as sending until lease and returns them, those due the
+	// longest first. Jobs left sending are due again once their lease ran
+	// out.
+	InsertMailJob(job MailJob) error
+	ClaimMailJobs(now, lease time.Time, limit int) ([]MailJob, error)
+	UpdateMailJob(job MailJob) error // replaces the job with the same ID
+	GetMailJob(ID string) (MailJob, error)
+	GetMailJobs(status string, limit int) ([]MailJob, error) // newest first
+	CountMailJobs() (map[string]int, error)                  // by status
+	PurgeSentMailJobs(before time.Time) (int, error)         // deletes jobs sent before, returns how many
+
+	// accounts of the admin pages, sorted by username
+	GetUsers() ([]User, error)
+	GetUser(ID string) (User, error)
+	GetUserByName(username string) (User, error)
+	InsertUser(user User) error
+	UpdateUser(user User) error // replaces the user with the same ID
+	DeleteUser(ID string) error
+
+	// site settings set from the admin pages
+	GetSetting(key string) (string, error) // ErrNotFound if never set
+	SetSetting(key, value string) error
+
+	// release resources held by the store
+	Close() error
+}
+
+// applies pending migrations if the store has a schema, then brings
+// posts stored by older versions up to date
+func migrateStore(store Store) (int, error) {
+	applied := 0
+	if m, ok := store.(migrator); ok {
+		var err error
+		if applied, err = m.Migrate(); err != nil {
+			return applied, err
+		}
+	}
+
+	if _, err := backfillSlugs(store); err != nil {
+		return applied, errors.New("slugs: " + err.Error())
+	}
+
+	if _, err := backfillContentHashes(store); err != nil {
+		return applied, errors.New("content hashes: " + err.Error())
+	}
+
+	if err := ensureOwner(store); err != nil {
+		return applied, errors.New("owner account: " + err.Error())
+	}
+
+	return applied, nil
+}
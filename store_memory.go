@@ -0,0 +1,764 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryStore keeps everything in process memory. It is meant for local
+// development and tests, all data is lost when the process exits.
+type memoryStore struct {
+	mu sync.RWMutex
+
+	posts       []NewPost
+	revisions   []Revision
+	comments    []Comment
+	subscribers []Subscriber
+	users       []User
+	settings    map[string]string
+	spamTokens  map[string]SpamToken
+	mailJobs    []MailJob
+	oldSlugs    map[string]string // slug: post ID
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{settings: map[string]string{}, spamTokens: map[string]SpamToken{}, oldSlugs: map[string]string{}}
+}
+
+func (m *memoryStore) Close() error {
+	return nil
+}
+
+func (m *memoryStore) GetPosts(filter PostFilter, skip, limit int64) ([]NewPost, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var posts []NewPost
+	for _, post := range m.posts {
+		if filter.Match(post) {
+			posts = append(posts, post)
+		}
+	}
+
+	// newest first, same as the mongo query
+	sort.SliceStable(posts, func(i, j int) bool {
+		return posts[i].Published.After(posts[j].Published)
+	})
+
+	return paginate(posts, skip, limit), nil
+}
+
+func (m *memoryStore) GetTags() ([]TagCount, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	counts := map[string]int{}
+	for _, post := range m.posts {
+		if !post.IsPublished() {
+			continue
+		}
+		for _, tag := range post.Tags {
+			counts[tag]++
+		}
+	}
+
+	tags := []TagCount{}
+	for name, count := range counts {
+		tags = append(tags, TagCount{Name: name, Count: count})
+	}
+
+	sort.Slice(tags, func(i, j int) bool {
+		return tags[i].Name < tags[j].Name
+	})
+
+	return tags, nil
+}
+
+func (m *memoryStore) GetDuePosts(now time.Time) ([]NewPost, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var posts []NewPost
+	for _, post := range m.posts {
+		if post.Status == PostScheduled && !post.Published.After(now) {
+			posts = append(posts, post)
+		}
+	}
+
+	return posts, nil
+}
+
+func (m *memoryStore) GetPost(ID string) (NewPost, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, post := range m.posts {
+		if post.ID == ID {
+			return post, nil
+		}
+	}
+
+	return NewPost{}, ErrNotFound
+}
+
+func (m *memoryStore) GetPostBySlug(slug string) (NewPost, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, post := range m.posts {
+		if post.Slug == slug && slug != "" {
+			return post, nil
+		}
+	}
+
+	return NewPost{}, ErrNotFound
+}
+
+func (m *memoryStore) GetPostByOldSlug(slug string) (NewPost, error) {
+	m.mu.RLock()
+	ID, ok := m.oldSlugs[slug]
+	m.mu.RUnlock()
+
+	if !ok {
+		return NewPost{}, ErrNotFound
+	}
+
+	return m.GetPost(ID)
+}
+
+func (m *memoryStore) AddOldSlug(slug, postID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.oldSlugs[slug] = postID
+	return nil
+}
+
+func (m *memoryStore) InsertPost(post NewPost) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.posts = append(m.posts, post)
+	return nil
+}
+
+func (m *memoryStore) UpdatePost(post NewPost) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.posts {
+		if m.posts[i].ID == post.ID {
+			m.posts[i] = post
+			return nil
+		}
+	}
+
+	return ErrNotFound
+}
+
+func (m *memoryStore) DeletePost(ID string) (DeletedPost, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	deleted := DeletedPost{}
+	found := false
+
+	posts := m.posts[:0]
+	for _, post := range m.posts {
+		if post.ID == ID {
+			deleted.Post, found = post, true
+			continue
+		}
+		posts = append(posts, post)
+	}
+
+	if !found {
+		return DeletedPost{}, ErrNotFound
+	}
+	m.posts = posts
+
+	comments := m.comments[:0]
+	for _, comment := range m.comments {
+		if comment.BelongsTo != ID {
+			comments = append(comments, comment)
+		} else if comment.ParentID != "" {
+			deleted.Replies++
+		} else {
+			deleted.Comments++
+		}
+	}
+	m.comments = comments
+
+	revisions := m.revisions[:0]
+	for _, rev := range m.revisions {
+		if rev.PostID == ID {
+			deleted.Revisions++
+			continue
+		}
+		revisions = append(revisions, rev)
+	}
+	m.revisions = revisions
+
+	for slug, postID := range m.oldSlugs {
+		if postID == ID {
+			delete(m.oldSlugs, slug)
+		}
+	}
+
+	return deleted, nil
+}
+
+func (m *memoryStore) GetRevisions(postID string) ([]Revision, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var revisions []Revision
+	for _, rev := range m.revisions {
+		if rev.PostID == postID {
+			revisions = append(revisions, rev)
+		}
+	}
+
+	sort.SliceStable(revisions, func(i, j int) bool {
+		return revisions[i].Saved.After(revisions[j].Saved)
+	})
+
+	return revisions, nil
+}
+
+func (m *memoryStore) GetRevision(ID string) (Revision, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, rev := range m.revisions {
+		if rev.ID == ID {
+			return rev, nil
+		}
+	}
+
+	return Revision{}, ErrNotFound
+}
+
+func (m *memoryStore) InsertRevision(rev Revision) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.revisions = append(m.revisions, rev)
+	return nil
+}
+
+func (m *memoryStore) GetComments(postID string) ([]Comment, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var comments []Comment
+	for _, comment := range m.comments {
+		if comment.BelongsTo == postID {
+			comments = append(comments, comment)
+		}
+	}
+
+	return comments, nil
+}
+
+func (m *memoryStore) CountComments(postIDs []string) (map[string]int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	// replies come after the comment they reply to
+	visible := map[string]bool{"": true}
+	counts := map[string]int{}
+	for _, comment := range m.comments {
+		if !Found(postIDs, comment.BelongsTo) || !comment.IsApproved() || !visible[comment.ParentID] {
+			continue
+		}
+
+		visible[comment.ID] = true
+		counts[comment.BelongsTo]++
+	}
+
+	return counts, nil
+}
+
+func (m *memoryStore) GetComment(ID string) (Comment, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, comment := range m.comments {
+		if comment.ID == ID {
+			return comment, nil
+		}
+	}
+
+	return Comment{}, ErrNotFound
+}
+
+func (m *memoryStore) GetCommentsByStatus(status string) ([]Comment, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var comments []Comment
+	for _, comment := range m.comments {
+		if comment.Status == status || (status == CommentApproved && comment.IsApproved()) {
+			comments = append(comments, comment)
+		}
+	}
+
+	return comments, nil
+}
+
+func (m *memoryStore) SetCommentStatus(ID, status, trained string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.comments {
+		if m.comments[i].ID == ID {
+			m.comments[i].Status = status
+			m.comments[i].Trained = trained
+			return nil
+		}
+	}
+
+	return ErrNotFound
+}
+
+func (m *memoryStore) SetCommentHash(ID, hash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.comments {
+		if m.comments[i].ID == ID {
+			m.comments[i].ContentHash = hash
+			return nil
+		}
+	}
+
+	return ErrNotFound
+}
+
+func (m *memoryStore) InsertComment(comment Comment) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.comments = append(m.comments, comment)
+	return nil
+}
+
+func (m *memoryStore) DeleteComment(ID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// the comment and the replies below it, replies come after what they
+	// reply to
+	thread := map[string]bool{}
+	for _, comment := range m.comments {
+		if comment.ID == ID || thread[comment.ParentID] {
+			thread[comment.ID] = true
+		}
+	}
+
+	if !thread[ID] {
+		return ErrNotFound
+	}
+
+	comments := m.comments[:0]
+	for _, comment := range m.comments {
+		if !thread[comment.ID] {
+			comments = append(comments, comment)
+		}
+	}
+	m.comments = comments
+
+	return nil
+}
+
+func (m *memoryStore) HasDuplicateComment(postID, parentID, hash string, since time.Time) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, comment := range m.comments {
+		if comment.BelongsTo == postID && comment.ParentID == parentID && comment.ContentHash == hash &&
+			!comment.DatabaseID.Timestamp().Before(since) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (m *memoryStore) IsApprovedCommenter(key string) (bool, error) {
+	if key == "" {
+		return false, nil
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, comment := range m.comments {
+		if comment.IsApproved() && comment.Commenter == key {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (m *memoryStore) GetSubscribers() ([]Subscriber, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var subscribers []Subscriber
+	for _, sub := range m.subscribers {
+		if sub.IsActive() {
+			subscribers = append(subscribers, sub)
+		}
+	}
+	return subscribers, nil
+}
+
+func (m *memoryStore) GetSubscriberByMail(mail string) (Subscriber, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, sub := range m.subscribers {
+		if sub.Mail == mail {
+			return sub, nil
+		}
+	}
+
+	return Subscriber{}, ErrNotFound
+}
+
+func (m *memoryStore) GetSubscriberByToken(token string) (Subscriber, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, sub := range m.subscribers {
+		if sub.Token == token && token != "" {
+			return sub, nil
+		}
+	}
+
+	return Subscriber{}, ErrNotFound
+}
+
+func (m *memoryStore) InsertSubscriber(subscriber Subscriber) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.subscribers = append(m.subscribers, subscriber)
+	return nil
+}
+
+func (m *memoryStore) ConfirmSubscriber(ID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.subscribers {
+		if m.subscribers[i].DatabaseID.Hex() == ID && m.subscribers[i].Status == SubscriberPending {
+			m.subscribers[i].Status = SubscriberActive
+			return nil
+		}
+	}
+
+	return ErrNotFound
+}
+
+func (m *memoryStore) UpdateSubscriber(sub Subscriber) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.subscribers {
+		if m.subscribers[i].DatabaseID == sub.DatabaseID {
+			m.subscribers[i] = sub
+			return nil
+		}
+	}
+
+	return ErrNotFound
+}
+
+func (m *memoryStore) DeleteSubscriber(ID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, sub := range m.subscribers {
+		if sub.DatabaseID.Hex() == ID {
+			m.subscribers = append(m.subscribers[:i], m.subscribers[i+1:]...)
+			return nil
+		}
+	}
+
+	return ErrNotFound
+}
+
+func (m *memoryStore) ExpireSubscribers(before time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	kept := m.subscribers[:0]
+	for _, sub := range m.subscribers {
+		if sub.Status != SubscriberPending || !sub.Created.Before(before) {
+			kept = append(kept, sub)
+		}
+	}
+
+	expired := len(m.subscribers) - len(kept)
+	m.subscribers = kept
+	return expired, nil
+}
+
+func (m *memoryStore) InsertMailJob(job MailJob) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.mailJobs = append(m.mailJobs, job)
+	return nil
+}
+
+func (m *memoryStore) ClaimMailJobs(now, lease time.Time, limit int) ([]MailJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var due []int
+	for i, job := range m.mailJobs {
+		if (job.Status == MailQueued || job.Status == MailSending) && !job.NextAttempt.After(now) {
+			due = append(due, i)
+		}
+	}
+
+	sort.SliceStable(due, func(i, j int) bool {
+		return m.mailJobs[due[i]].NextAttempt.Before(m.mailJobs[due[j]].NextAttempt)
+	})
+
+	var jobs []MailJob
+	for _, i := range due {
+		if len(jobs) == limit {
+			break
+		}
+
+		m.mailJobs[i].Status, m.mailJobs[i].NextAttempt = MailSending, lease
+		jobs = append(jobs, m.mailJobs[i])
+	}
+
+	return jobs, nil
+}
+
+func (m *memoryStore) UpdateMailJob(job MailJob) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.mailJobs {
+		if m.mailJobs[i].ID == job.ID {
+			m.mailJobs[i] = job
+			return nil
+		}
+	}
+
+	return ErrNotFound
+}
+
+func (m *memoryStore) GetMailJob(ID string) (MailJob, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, job := range m.mailJobs {
+		if job.ID == ID {
+			return job, nil
+		}
+	}
+
+	return MailJob{}, ErrNotFound
+}
+
+func (m *memoryStore) GetMailJobs(status string, limit int) ([]MailJob, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var jobs []MailJob
+	for i := len(m.mailJobs) - 1; i >= 0 && len(jobs) < limit; i-- {
+		if m.mailJobs[i].Status == status {
+			jobs = append(jobs, m.mailJobs[i])
+		}
+	}
+
+	return jobs, nil
+}
+
+func (m *memoryStore) CountMailJobs() (map[string]int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	counts := map[string]int{}
+	for _, job := range m.mailJobs {
+		counts[job.Status]++
+	}
+
+	return counts, nil
+}
+
+func (m *memoryStore) PurgeSentMailJobs(before time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	kept := m.mailJobs[:0]
+	for _, job := range m.mailJobs {
+		if job.Status != MailSent || !job.Sent.Before(before) {
+			kept = append(kept, job)
+		}
+	}
+
+	purged := len(m.mailJobs) - len(kept)
+	m.mailJobs = kept
+	return purged, nil
+}
+
+func (m *memoryStore) GetUsers() ([]User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	users := make([]User, len(m.users))
+	copy(users, m.users)
+
+	sort.SliceStable(users, func(i, j int) bool {
+		return users[i].Username < users[j].Username
+	})
+
+	return users, nil
+}
+
+func (m *memoryStore) GetUser(ID string) (User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, user := range m.users {
+		if user.ID == ID {
+			return user, nil
+		}
+	}
+
+	return User{}, ErrNotFound
+}
+
+func (m *memoryStore) GetUserByName(username string) (User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, user := range m.users {
+		if user.Username == username {
+			return user, nil
+		}
+	}
+
+	return User{}, ErrNotFound
+}
+
+func (m *memoryStore) InsertUser(user User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.users = append(m.users, user)
+	return nil
+}
+
+func (m *memoryStore) UpdateUser(user User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.users {
+		if m.users[i].ID == user.ID {
+			m.users[i] = user
+			return nil
+		}
+	}
+
+	return ErrNotFound
+}
+
+func (m *memoryStore) DeleteUser(ID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.users {
+		if m.users[i].ID == ID {
+			m.users = append(m.users[:i], m.users[i+1:]...)
+			return nil
+		}
+	}
+
+	return ErrNotFound
+}
+
+func (m *memoryStore) GetSetting(key string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	value, ok := m.settings[key]
+	if !ok {
+		return "", ErrNotFound
+	}
+
+	return value, nil
+}
+
+func (m *memoryStore) SetSetting(key, value string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.settings[key] = value
+	return nil
+}
+
+func (m *memoryStore) GetSpamTokens(tokens []string) (map[string]SpamToken, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	counts := map[string]SpamToken{}
+	for _, token := range tokens {
+		if count, ok := m.spamTokens[token]; ok {
+			counts[token] = count
+		}
+	}
+
+	return counts, nil
+}
+
+func (m *memoryStore) AddSpamTokens(tokens []string, spam, ham int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, token := range tokens {
+		count := m.spamTokens[token]
+		count.Token = token
+		count.Spam = max0(count.Spam + spam)
+		count.Ham = max0(count.Ham + ham)
+		m.spamTokens[token] = count
+	}
+
+	return nil
+}
+
+func max0(n int) int {
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// returns at most limit posts after skipping the first skip posts
+func paginate(posts []NewPost, skip, limit int64) []NewPost {
+	if skip < 0 {
+		skip = 0
+	}
+	if skip >= int64(len(posts)) {
+		return nil
+	}
+	posts = posts[skip:]
+
+	if limit > 0 && limit < int64(len(posts)) {
+		posts = posts[:limit]
+	}
+
+	return posts
+}
@@ -0,0 +1,965 @@
+package main
+
+import (
+	"context"
+	"html"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mongoStore is the MongoDB Atlas implementation of Store
+type mongoStore struct {
+	ctx    context.Context
+	client *mongo.Client
+
+	blogPosts    *mongo.Collection
+	blogComments *mongo.Collection
+	blogReplies  *mongo.Collection // replies from before threads, only migrations use it
+	emails       *mongo.Collection
+	revisions    *mongo.Collection
+	migrations   *mongo.Collection
+	users        *mongo.Collection
+	settings     *mongo.Collection
+	spamTokens   *mongo.Collection
+	mailJobs     *mongo.Collection
+	oldSlugs     *mongo.Collection
+}
+
+// mongoMigrations are applied in order like sqliteMigrations, a document per
+// applied migration is kept in the schema-migrations collection
+var mongoMigrations = []func(m *mongoStore) error{
+	// 1: unique slugs, posts stored before slugs existed have none
+	func(m *mongoStore) error {
+		_, err := m.blogPosts.Indexes().CreateOne(m.ctx, mongo.IndexModel{
+			Keys: bson.M{"slug": 1},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"slug": bson.M{"$gt": ""}}),
+		})
+		return err
+	},
+
+	// 2: comments, replies and subscribers were stored html escaped,
+	// templates escape them now
+	func(m *mongoStore) error {
+		if err := m.unescapeFields(m.blogComments, "commentor", "comment"); err != nil {
+			return err
+		}
+		if err := m.unescapeFields(m.blogReplies, "commentor", "comment"); err != nil {
+			return err
+		}
+		return m.unescapeFields(m.emails, "mail")
+	},
+
+	// 3: user accounts, usernames log in so they are unique
+	func(m *mongoStore) error {
+		_, err := m.users.Indexes().CreateOne(m.ctx, mongo.IndexModel{
+			Keys:    bson.M{"username": 1},
+			Options: options.Index().SetUnique(true),
+		})
+		return err
+	},
+
+	// 4: duplicate comments and replies are looked up by content hash,
+	// existing ones get theirs from backfillContentHashes
+	func(m *mongoStore) error {
+		for _, coll := range []*mongo.Collection{m.blogComments, m.blogReplies} {
+			_, err := coll.Indexes().CreateOne(m.ctx, mongo.IndexModel{
+				Keys: bson.D{{Key: "belongsto", Value: 1}, {Key: "contenthash", Value: 1}, {Key: "_id", Value: 1}},
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+
+	// 5: threaded comments, replies become comments replying to the comment
+	// they belonged to
+	func(m *mongoStore) error {
+		cursor, err := m.blogReplies.Find(m.ctx, bson.M{})
+		if err != nil {
+			return err
+		}
+
+		var replies []bson.M
+		if err := cursor.All(m.ctx, &replies); err != nil {
+			return err
+		}
+
+		for _, reply := range replies {
+			var parent Comment
+			if err := m.blogComments.FindOne(m.ctx, bson.M{"id": reply["belongsto"]}).Decode(&parent); err != nil {
+				if err == mongo.ErrNoDocuments {
+					continue // its comment is gone
+				}
+				return err
+			}
+
+			database_ID, _ := reply["_id"].(primitive.ObjectID)
+			reply["id"] = database_ID.Hex()
+			reply["parentid"] = parent.ID
+			reply["belongsto"] = parent.BelongsTo
+			reply["depth"] = 1
+
+			// an upsert so an interrupted migration can run again
+			_, err := m.blogComments.ReplaceOne(m.ctx, bson.M{"_id": database_ID}, reply, options.Replace().SetUpsert(true))
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = m.blogComments.Indexes().CreateOne(m.ctx, mongo.IndexModel{Keys: bson.M{"parentid": 1}})
+		if err != nil {
+			return err
+		}
+
+		return m.blogReplies.Drop(m.ctx)
+	},
+
+	// 6: outgoing mail queue, looked up by status and due time
+	func(m *mongoStore) error {
+		_, err := m.mailJobs.Indexes().CreateMany(m.ctx, []mongo.IndexModel{
+			{Keys: bson.D{{Key: "status", Value: 1}, {Key: "nextattempt", Value: 1}}},
+			{Keys: bson.M{"id": 1}, Options: options.Index().SetUnique(true)},
+		})
+		return err
+	},
+
+	// 7: double opt-in, pending subscribers are expired by creation time
+	func(m *mongoStore) error {
+		_, err := m.emails.Indexes().CreateOne(m.ctx, mongo.IndexModel{
+			Keys: bson.D{{Key: "status", Value: 1}, {Key: "created", Value: 1}},
+		})
+		return err
+	},
+
+	// 8: first-time moderation looks up approved comments by commenter key
+	func(m *mongoStore) error {
+		_, err := m.blogComments.Indexes().CreateOne(m.ctx, mongo.IndexModel{
+			Keys: bson.D{{Key: "commenter", Value: 1}, {Key: "status", Value: 1}},
+			Options: options.Index().
+				SetPartialFilterExpression(bson.M{"commenter": bson.M{"$gt": ""}}),
+		})
+		return err
+	},
+
+	// 9: slugs of renamed posts, their links redirect to the new slug
+	func(m *mongoStore) error {
+		_, err := m.oldSlugs.Indexes().CreateMany(m.ctx, []mongo.IndexModel{
+			{Keys: bson.M{"slug": 1}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.M{"postid": 1}},
+		})
+		return err
+	},
+
+	// 10: random tokens in the links of subscriber mails, those of the
+	// subscribers from before are made here
+	func(m *mongoStore) error {
+		cursor, err := m.emails.Find(m.ctx, bson.M{"token": bson.M{"$in": bson.A{"", nil}}})
+		if err != nil {
+			return err
+		}
+
+		var subscribers []Subscriber
+		if err := cursor.All(m.ctx, &subscribers); err != nil {
+			return err
+		}
+
+		for _, sub := range subscribers {
+			_, err := m.emails.UpdateOne(m.ctx, bson.M{"_id": sub.DatabaseID}, bson.M{"$set": bson.M{"token": newSubscriberToken()}})
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = m.emails.Indexes().CreateOne(m.ctx, mongo.IndexModel{
+			Keys: bson.M{"token": 1},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"token": bson.M{"$gt": ""}}),
+		})
+		return err
+	},
+}
+
+// connects to the mongo cluster at uri and returns a store backed by it
+func newMongoStore(uri string) (*mongoStore, error) {
+	ctx := context.Background()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		return nil, err
+	}
+
+	database := client.Database("student-devs-blog")
+
+	return &mongoStore{
+		ctx:          ctx,
+		client:       client,
+		blogPosts:    database.Collection("blog-posts"),
+		blogComments: database.Collection("blog-comments"),
+		blogReplies:  database.Collection("blog-replies"),
+		emails:       database.Collection("emails"),
+		revisions:    database.Collection("post-revisions"),
+		migrations:   database.Collection("schema-migrations"),
+		users:        database.Collection("users"),
+		settings:     database.Collection("settings"),
+		spamTokens:   database.Collection("spam-tokens"),
+		mailJobs:     database.Collection("mail-jobs"),
+		oldSlugs:     database.Collection("old-slugs"),
+	}, nil
+}
+
+// Migrate applies every migration newer than the last recorded one and
+// returns how many were applied
+func (m *mongoStore) Migrate() (int, error) {
+	version, err := m.migrations.CountDocuments(m.ctx, bson.M{})
+	if err != nil {
+		return 0, err
+	}
+
+	applied := 0
+	for i := int(version); i < len(mongoMigrations); i++ {
+		if err := mongoMigrations[i](m); err != nil {
+			return applied, err
+		}
+
+		if _, err := m.migrations.InsertOne(m.ctx, bson.M{"version": i + 1, "applied_at": time.Now()}); err != nil {
+			return applied, err
+		}
+		applied++
+	}
+
+	return applied, nil
+}
+
+// html unescapes the string fields of every document in coll
+func (m *mongoStore) unescapeFields(coll *mongo.Collection, fields ...string) error {
+	cursor, err := coll.Find(m.ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(m.ctx)
+
+	for cursor.Next(m.ctx) {
+		var doc bson.M
+		if err := cursor.Decode(&doc); err != nil {
+			return err
+		}
+
+		set := bson.M{}
+		for _, field := range fields {
+			if value, ok := doc[field].(string); ok && html.UnescapeString(value) != value {
+				set[field] = html.UnescapeString(value)
+			}
+		}
+
+		if len(set) == 0 {
+			continue
+		}
+
+		if _, err := coll.UpdateOne(m.ctx, bson.M{"_id": doc["_id"]}, bson.M{"$set": set}); err != nil {
+			return err
+		}
+	}
+
+	return cursor.Err()
+}
+
+func (m *mongoStore) Close() error {
+	return m.client.Disconnect(m.ctx)
+}
+
+func (m *mongoStore) GetPosts(filter PostFilter, skip, limit int64) ([]NewPost, error) {
+	findOptions := options.FindOptions{
+		Limit: &limit,
+		Skip:  &skip,
+		Sort:  bson.M{"published": -1},
+	}
+
+	query := bson.M{}
+	if filter.PublishedOnly {
+		// posts stored before statuses existed have no status field
+		query["status"] = bson.M{"$in": bson.A{PostPublished, "", nil}}
+	}
+	if filter.Tag != "" {
+		query["tags"] = filter.Tag
+	}
+	if filter.Category != "" {
+		query["category"] = filter.Category
+	}
+	if filter.Author != "" {
+		query["author"] = filter.Author
+	}
+
+	return m.findPosts(query, &findOptions)
+}
+
+func (m *mongoStore) GetTags() ([]TagCount, error) {
+	cursor, err := m.blogPosts.Aggregate(m.ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"status": bson.M{"$in": bson.A{PostPublished, "", nil}}}}},
+		{{Key: "$unwind", Value: "$tags"}},
+		{{Key: "$group", Value: bson.M{"_id": "$tags", "count": bson.M{"$sum": 1}}}},
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(m.ctx)
+
+	var tags []TagCount
+	if err := cursor.All(m.ctx, &tags); err != nil {
+		return nil, err
+	}
+
+	return tags, nil
+}
+
+func (m *mongoStore) GetDuePosts(now time.Time) ([]NewPost, error) {
+	return m.findPosts(bson.M{"status": PostScheduled, "published": bson.M{"$lte": now}})
+}
+
+func (m *mongoStore) findPosts(filter bson.M, opts ...*options.FindOptions) ([]NewPost, error) {
+	cursor, err := m.blogPosts.Find(m.ctx, filter, opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(m.ctx)
+
+	var posts []NewPost
+	if err := cursor.All(m.ctx, &posts); err != nil {
+		return nil, err
+	}
+
+	return posts, nil
+}
+
+func (m *mongoStore) GetPost(ID string) (NewPost, error) {
+	var post NewPost
+	if err := m.blogPosts.FindOne(m.ctx, bson.M{"id": ID}).Decode(&post); err != nil {
+		return NewPost{}, mongoError(err)
+	}
+
+	return post, nil
+}
+
+func (m *mongoStore) GetPostBySlug(slug string) (NewPost, error) {
+	var post NewPost
+	if err := m.blogPosts.FindOne(m.ctx, bson.M{"slug": slug}).Decode(&post); err != nil {
+		return NewPost{}, mongoError(err)
+	}
+
+	return post, nil
+}
+
+func (m *mongoStore) GetPostByOldSlug(slug string) (NewPost, error) {
+	var old struct {
+		PostID string `bson:"postid"`
+	}
+	if err := m.oldSlugs.FindOne(m.ctx, bson.M{"slug": slug}).Decode(&old); err != nil {
+		return NewPost{}, mongoError(err)
+	}
+
+	return m.GetPost(old.PostID)
+}
+
+func (m *mongoStore) AddOldSlug(slug, postID string) error {
+	_, err := m.oldSlugs.UpdateOne(m.ctx, bson.M{"slug": slug}, bson.M{"$set": bson.M{"postid": postID}}, options.Update().SetUpsert(true))
+	return err
+}
+
+func (m *mongoStore) InsertPost(post NewPost) error {
+	_, err := m.blogPosts.InsertOne(m.ctx, post)
+	return err
+}
+
+func (m *mongoStore) UpdatePost(post NewPost) error {
+	result, err := m.blogPosts.ReplaceOne(m.ctx, bson.M{"id": post.ID}, post)
+	if err != nil {
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (m *mongoStore) DeletePost(ID string) (DeletedPost, error) {
+	post, err := m.GetPost(ID)
+	if err != nil {
+		return DeletedPost{}, err
+	}
+
+	replies, err := m.blogComments.DeleteMany(m.ctx, bson.M{"belongsto": ID, "parentid": bson.M{"$gt": ""}})
+	if err != nil {
+		return DeletedPost{}, err
+	}
+
+	deletedComments, err := m.blogComments.DeleteMany(m.ctx, bson.M{"belongsto": ID})
+	if err != nil {
+		return DeletedPost{}, err
+	}
+
+	revisions, err := m.revisions.DeleteMany(m.ctx, bson.M{"postid": ID})
+	if err != nil {
+		return DeletedPost{}, err
+	}
+
+	if _, err := m.oldSlugs.DeleteMany(m.ctx, bson.M{"postid": ID}); err != nil {
+		return DeletedPost{}, err
+	}
+
+	if _, err := m.blogPosts.DeleteOne(m.ctx, bson.M{"id": ID}); err != nil {
+		return DeletedPost{}, err
+	}
+
+	return DeletedPost{
+		Post:      post,
+		Comments:  int(deletedComments.DeletedCount),
+		Replies:   int(replies.DeletedCount),
+		Revisions: int(revisions.DeletedCount),
+	}, nil
+}
+
+func (m *mongoStore) GetRevisions(postID string) ([]Revision, error) {
+	cursor, err := m.revisions.Find(m.ctx, bson.M{"postid": postID}, options.Find().SetSort(bson.M{"saved": -1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(m.ctx)
+
+	var revisions []Revision
+	if err := cursor.All(m.ctx, &revisions); err != nil {
+		return nil, err
+	}
+
+	return revisions, nil
+}
+
+func (m *mongoStore) GetRevision(ID string) (Revision, error) {
+	var rev Revision
+	if err := m.revisions.FindOne(m.ctx, bson.M{"id": ID}).Decode(&rev); err != nil {
+		return Revision{}, mongoError(err)
+	}
+
+	return rev, nil
+}
+
+func (m *mongoStore) InsertRevision(rev Revision) error {
+	_, err := m.revisions.InsertOne(m.ctx, rev)
+	return err
+}
+
+func (m *mongoStore) GetComments(postID string) ([]Comment, error) {
+	return m.findComments(bson.M{"belongsto": postID})
+}
+
+func (m *mongoStore) GetComment(ID string) (Comment, error) {
+	var comment Comment
+	if err := m.blogComments.FindOne(m.ctx, bson.M{"id": ID}).Decode(&comment); err != nil {
+		return Comment{}, mongoError(err)
+	}
+
+	return comment, nil
+}
+
+// one aggregation: the approved comments starting threads, each with the
+// approved replies reachable through approved comments
+func (m *mongoStore) CountComments(postIDs []string) (map[string]int, error) {
+	approved := statusQuery(CommentApproved)
+
+	start := statusQuery(CommentApproved)
+	start["belongsto"] = bson.M{"$in": postIDs}
+	start["parentid"] = bson.M{"$in": bson.A{"", nil}}
+
+	cursor, err := m.blogComments.Aggregate(m.ctx, mongo.Pipeline{
+		{{Key: "$match", Value: start}},
+		{{Key: "$graphLookup", Value: bson.M{
+			"from":                    m.blogComments.Name(),
+			"startWith":               "$id",
+			"connectFromField":        "id",
+			"connectToField":          "parentid",
+			"as":                      "replies",
+			"restrictSearchWithMatch": approved,
+		}}},
+		{{Key: "$group", Value: bson.M{"_id": "$belongsto", "count": bson.M{"$sum": bson.M{"$add": bson.A{1, bson.M{"$size": "$replies"}}}}}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(m.ctx)
+
+	var results []struct {
+		PostID string `bson:"_id"`
+		Count  int    `bson:"count"`
+	}
+	if err := cursor.All(m.ctx, &results); err != nil {
+		return nil, err
+	}
+
+	counts := map[string]int{}
+	for _, result := range results {
+		counts[result.PostID] = result.Count
+	}
+
+	return counts, nil
+}
+
+func (m *mongoStore) GetCommentsByStatus(status string) ([]Comment, error) {
+	return m.findComments(statusQuery(status))
+}
+
+// query for a moderation status, comments stored before moderation have none
+func statusQuery(status string) bson.M {
+	if status == CommentApproved {
+		return bson.M{"status": bson.M{"$in": bson.A{CommentApproved, "", nil}}}
+	}
+	return bson.M{"status": status}
+}
+
+func (m *mongoStore) SetCommentStatus(ID, status, trained string) error {
+	result, err := m.blogComments.UpdateOne(m.ctx, bson.M{"id": ID}, bson.M{"$set": bson.M{"status": status, "trained": trained}})
+	if err != nil {
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (m *mongoStore) SetCommentHash(ID, hash string) error {
+	result, err := m.blogComments.UpdateOne(m.ctx, bson.M{"id": ID}, bson.M{"$set": bson.M{"contenthash": hash}})
+	if err != nil {
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (m *mongoStore) InsertComment(comment Comment) error {
+	_, err := m.blogComments.InsertOne(m.ctx, comment)
+	return err
+}
+
+func (m *mongoStore) DeleteComment(ID string) error {
+	if err := m.blogComments.FindOne(m.ctx, bson.M{"id": ID}).Err(); err != nil {
+		return mongoError(err)
+	}
+
+	// the comment and the replies below it, a level at a time
+	thread := []string{ID}
+	for level := []string{ID}; len(level) > 0; {
+		cursor, err := m.blogComments.Find(m.ctx, bson.M{"parentid": bson.M{"$in": level}}, options.Find().SetProjection(bson.M{"id": 1}))
+		if err != nil {
+			return err
+		}
+
+		var replies []Comment
+		if err := cursor.All(m.ctx, &replies); err != nil {
+			return err
+		}
+
+		level = nil
+		for _, reply := range replies {
+			level = append(level, reply.ID)
+		}
+		thread = append(thread, level...)
+	}
+
+	_, err := m.blogComments.DeleteMany(m.ctx, bson.M{"id": bson.M{"$in": thread}})
+	return err
+}
+
+// object IDs start with their creation time, so they tell the age of
+// comments
+func (m *mongoStore) HasDuplicateComment(postID, parentID, hash string, since time.Time) (bool, error) {
+	filter := bson.M{"belongsto": postID, "contenthash": hash, "parentid": parentID}
+	if parentID == "" {
+		// comments from before threads have no parentid
+		filter["parentid"] = bson.M{"$in": bson.A{"", nil}}
+	}
+
+	if !since.IsZero() {
+		filter["_id"] = bson.M{"$gte": primitive.NewObjectIDFromTimestamp(since)}
+	}
+
+	err := m.blogComments.FindOne(m.ctx, filter).Err()
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func (m *mongoStore) IsApprovedCommenter(key string) (bool, error) {
+	if key == "" {
+		return false, nil
+	}
+
+	query := statusQuery(CommentApproved)
+	query["commenter"] = key
+
+	err := m.blogComments.FindOne(m.ctx, query).Err()
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// subscribers from before double opt-in have no status and are active
+func (m *mongoStore) GetSubscribers() ([]Subscriber, error) {
+	cursor, err := m.emails.Find(m.ctx, bson.M{"status": bson.M{"$in": bson.A{SubscriberActive, "", nil}}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(m.ctx)
+
+	var subscribers []Subscriber
+	if err := cursor.All(m.ctx, &subscribers); err != nil {
+		return nil, err
+	}
+
+	return subscribers, nil
+}
+
+func (m *mongoStore) GetSubscriberByMail(mail string) (Subscriber, error) {
+	return m.getSubscriber(bson.M{"mail": mail})
+}
+
+func (m *mongoStore) GetSubscriberByToken(token string) (Subscriber, error) {
+	if token == "" {
+		return Subscriber{}, ErrNotFound
+	}
+
+	return m.getSubscriber(bson.M{"token": token})
+}
+
+func (m *mongoStore) getSubscriber(filter bson.M) (Subscriber, error) {
+	var sub Subscriber
+	if err := m.emails.FindOne(m.ctx, filter).Decode(&sub); err != nil {
+		return Subscriber{}, mongoError(err)
+	}
+
+	return sub, nil
+}
+
+func (m *mongoStore) InsertSubscriber(subscriber Subscriber) error {
+	_, err := m.emails.InsertOne(m.ctx, subscriber)
+	return err
+}
+
+func (m *mongoStore) ConfirmSubscriber(ID string) error {
+	database_ID, err := primitive.ObjectIDFromHex(ID)
+	if err != nil {
+		return ErrNotFound
+	}
+
+	result, err := m.emails.UpdateOne(m.ctx, bson.M{"_id": database_ID, "status": SubscriberPending}, bson.M{"$set": bson.M{"status": SubscriberActive}})
+	if err != nil {
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (m *mongoStore) UpdateSubscriber(sub Subscriber) error {
+	result, err := m.emails.ReplaceOne(m.ctx, bson.M{"_id": sub.DatabaseID}, sub)
+	if err != nil {
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (m *mongoStore) DeleteSubscriber(ID string) error {
+	database_ID, err := primitive.ObjectIDFromHex(ID)
+	if err != nil {
+		return ErrNotFound
+	}
+
+	result, err := m.emails.DeleteOne(m.ctx, bson.M{"_id": database_ID})
+	if err != nil {
+		return err
+	}
+
+	if result.DeletedCount == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (m *mongoStore) ExpireSubscribers(before time.Time) (int, error) {
+	result, err := m.emails.DeleteMany(m.ctx, bson.M{"status": SubscriberPending, "created": bson.M{"$lt": before}})
+	if err != nil {
+		return 0, err
+	}
+
+	return int(result.DeletedCount), nil
+}
+
+func (m *mongoStore) InsertMailJob(job MailJob) error {
+	_, err := m.mailJobs.InsertOne(m.ctx, job)
+	return err
+}
+
+// claims the jobs one by one, each update is atomic
+func (m *mongoStore) ClaimMailJobs(now, lease time.Time, limit int) ([]MailJob, error) {
+	filter := bson.M{"status": bson.M{"$in": bson.A{MailQueued, MailSending}}, "nextattempt": bson.M{"$lte": now}}
+	update := bson.M{"$set": bson.M{"status": MailSending, "nextattempt": lease}}
+	opts := options.FindOneAndUpdate().SetSort(bson.M{"nextattempt": 1}).SetReturnDocument(options.After)
+
+	var jobs []MailJob
+	for len(jobs) < limit {
+		var job MailJob
+		err := m.mailJobs.FindOneAndUpdate(m.ctx, filter, update, opts).Decode(&job)
+		if err == mongo.ErrNoDocuments {
+			break
+		}
+		if err != nil {
+			return jobs, err
+		}
+
+		jobs = append(jobs, job)
+	}
+
+	return jobs, nil
+}
+
+func (m *mongoStore) UpdateMailJob(job MailJob) error {
+	result, err := m.mailJobs.ReplaceOne(m.ctx, bson.M{"id": job.ID}, job)
+	if err != nil {
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (m *mongoStore) GetMailJob(ID string) (MailJob, error) {
+	var job MailJob
+	if err := m.mailJobs.FindOne(m.ctx, bson.M{"id": ID}).Decode(&job); err != nil {
+		return MailJob{}, mongoError(err)
+	}
+
+	return job, nil
+}
+
+func (m *mongoStore) GetMailJobs(status string, limit int) ([]MailJob, error) {
+	cursor, err := m.mailJobs.Find(m.ctx, bson.M{"status": status}, options.Find().SetSort(bson.M{"_id": -1}).SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(m.ctx)
+
+	var jobs []MailJob
+	if err := cursor.All(m.ctx, &jobs); err != nil {
+		return nil, err
+	}
+
+	return jobs, nil
+}
+
+func (m *mongoStore) CountMailJobs() (map[string]int, error) {
+	cursor, err := m.mailJobs.Aggregate(m.ctx, mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{"_id": "$status", "count": bson.M{"$sum": 1}}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(m.ctx)
+
+	var results []struct {
+		Status string `bson:"_id"`
+		Count  int    `bson:"count"`
+	}
+	if err := cursor.All(m.ctx, &results); err != nil {
+		return nil, err
+	}
+
+	counts := map[string]int{}
+	for _, result := range results {
+		counts[result.Status] = result.Count
+	}
+
+	return counts, nil
+}
+
+func (m *mongoStore) PurgeSentMailJobs(before time.Time) (int, error) {
+	result, err := m.mailJobs.DeleteMany(m.ctx, bson.M{"status": MailSent, "sent": bson.M{"$lt": before}})
+	if err != nil {
+		return 0, err
+	}
+
+	return int(result.DeletedCount), nil
+}
+
+func (m *mongoStore) GetUsers() ([]User, error) {
+	cursor, err := m.users.Find(m.ctx, bson.M{}, options.Find().SetSort(bson.M{"username": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(m.ctx)
+
+	var users []User
+	if err := cursor.All(m.ctx, &users); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+func (m *mongoStore) GetUser(ID string) (User, error) {
+	var user User
+	if err := m.users.FindOne(m.ctx, bson.M{"id": ID}).Decode(&user); err != nil {
+		return User{}, mongoError(err)
+	}
+
+	return user, nil
+}
+
+func (m *mongoStore) GetUserByName(username string) (User, error) {
+	var user User
+	if err := m.users.FindOne(m.ctx, bson.M{"username": username}).Decode(&user); err != nil {
+		return User{}, mongoError(err)
+	}
+
+	return user, nil
+}
+
+func (m *mongoStore) InsertUser(user User) error {
+	_, err := m.users.InsertOne(m.ctx, user)
+	return err
+}
+
+func (m *mongoStore) UpdateUser(user User) error {
+	result, err := m.users.ReplaceOne(m.ctx, bson.M{"id": user.ID}, user)
+	if err != nil {
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (m *mongoStore) DeleteUser(ID string) error {
+	result, err := m.users.DeleteOne(m.ctx, bson.M{"id": ID})
+	if err != nil {
+		return err
+	}
+
+	if result.DeletedCount == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (m *mongoStore) GetSetting(key string) (string, error) {
+	var setting struct {
+		Value string `bson:"value"`
+	}
+
+	if err := m.settings.FindOne(m.ctx, bson.M{"_id": key}).Decode(&setting); err != nil {
+		return "", mongoError(err)
+	}
+
+	return setting.Value, nil
+}
+
+func (m *mongoStore) SetSetting(key, value string) error {
+	_, err := m.settings.ReplaceOne(m.ctx, bson.M{"_id": key}, bson.M{"_id": key, "value": value}, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (m *mongoStore) GetSpamTokens(tokens []string) (map[string]SpamToken, error) {
+	cursor, err := m.spamTokens.Find(m.ctx, bson.M{"_id": bson.M{"$in": tokens}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(m.ctx)
+
+	var found []SpamToken
+	if err := cursor.All(m.ctx, &found); err != nil {
+		return nil, err
+	}
+
+	counts := map[string]SpamToken{}
+	for _, count := range found {
+		counts[count.Token] = count
+	}
+
+	return counts, nil
+}
+
+func (m *mongoStore) AddSpamTokens(tokens []string, spam, ham int) error {
+	if len(tokens) == 0 {
+		return nil
+	}
+
+	// an update pipeline so the counts can be kept from going negative
+	update := bson.A{bson.M{"$set": bson.M{
+		"spam": bson.M{"$max": bson.A{0, bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$spam", 0}}, spam}}}},
+		"ham":  bson.M{"$max": bson.A{0, bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$ham", 0}}, ham}}}},
+	}}}
+
+	var models []mongo.WriteModel
+	for _, token := range tokens {
+		models = append(models, mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": token}).SetUpdate(update).SetUpsert(true))
+	}
+
+	_, err := m.spamTokens.BulkWrite(m.ctx, models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+// comments matching filter, oldest first like the other stores, _id starts
+// with the creation time
+func (m *mongoStore) findComments(filter bson.M) ([]Comment, error) {
+	cursor, err := m.blogComments.Find(m.ctx, filter, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(m.ctx)
+
+	var comments []Comment
+	if err := cursor.All(m.ctx, &comments); err != nil {
+		return nil, err
+	}
+
+	return comments, nil
+}
+
+// maps driver errors to store errors
+func mongoError(err error) error {
+	if err == mongo.ErrNoDocuments {
+		return ErrNotFound
+	}
+	return err
+}
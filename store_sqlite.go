@@ -0,0 +1,1183 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// sqliteMigrations are applied in order, the index+1 of a migration is its
+// schema version. Never edit a released migration, append a new one instead.
+var sqliteMigrations = []string{
+	// 1: initial schema
+	`CREATE TABLE posts (
+		id           TEXT PRIMARY KEY,
+		object_id    TEXT NOT NULL,
+		title        TEXT NOT NULL,
+		published    TIMESTAMP NOT NULL,
+		readtime     REAL NOT NULL DEFAULT 0,
+		content      TEXT NOT NULL DEFAULT '',
+		imagename    TEXT NOT NULL DEFAULT '',
+		bptitle      TEXT NOT NULL DEFAULT '',
+		bulletpoints TEXT NOT NULL DEFAULT '[]',
+		bqtitle      TEXT NOT NULL DEFAULT '',
+		blogquote    TEXT NOT NULL DEFAULT '',
+		quoteauthor  TEXT NOT NULL DEFAULT '',
+		videopath    TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX posts_published ON posts (published);
+
+	CREATE TABLE comments (
+		id        TEXT PRIMARY KEY,
+		object_id TEXT NOT NULL,
+		belongsto TEXT NOT NULL,
+		commentor TEXT NOT NULL,
+		comment   TEXT NOT NULL
+	);
+	CREATE INDEX comments_belongsto ON comments (belongsto);
+
+	CREATE TABLE replies (
+		object_id TEXT PRIMARY KEY,
+		belongsto TEXT NOT NULL,
+		commentor TEXT NOT NULL,
+		comment   TEXT NOT NULL
+	);
+	CREATE INDEX replies_belongsto ON replies (belongsto);
+
+	CREATE TABLE subscribers (
+		object_id TEXT PRIMARY KEY,
+		mail      TEXT NOT NULL UNIQUE
+	);`,
+
+	// 2: post status for drafts and scheduled posts
+	`ALTER TABLE posts ADD COLUMN status TEXT NOT NULL DEFAULT 'published';
+	CREATE INDEX posts_status_published ON posts (status, published);`,
+
+	// 3: post revision history
+	`CREATE TABLE revisions (
+		id           TEXT PRIMARY KEY,
+		object_id    TEXT NOT NULL,
+		postid       TEXT NOT NULL,
+		saved        TIMESTAMP NOT NULL,
+		editor       TEXT NOT NULL DEFAULT '',
+		note         TEXT NOT NULL DEFAULT '',
+		title        TEXT NOT NULL,
+		content      TEXT NOT NULL DEFAULT '',
+		imagename    TEXT NOT NULL DEFAULT '',
+		bptitle      TEXT NOT NULL DEFAULT '',
+		bulletpoints TEXT NOT NULL DEFAULT '[]',
+		bqtitle      TEXT NOT NULL DEFAULT '',
+		blogquote    TEXT NOT NULL DEFAULT '',
+		quoteauthor  TEXT NOT NULL DEFAULT '',
+		videopath    TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX revisions_postid_saved ON revisions (postid, saved);`,
+
+	// 4: url slugs, existing posts get theirs from backfillSlugs
+	`ALTER TABLE posts ADD COLUMN slug TEXT NOT NULL DEFAULT '';
+	CREATE UNIQUE INDEX posts_slug ON posts (slug) WHERE slug != '';`,
+
+	// 5: tags (json array, like bulletpoints) and categories
+	`ALTER TABLE posts ADD COLUMN tags TEXT NOT NULL DEFAULT '[]';
+	ALTER TABLE posts ADD COLUMN category TEXT NOT NULL DEFAULT '';
+	CREATE INDEX posts_category_published ON posts (category, published);`,
+
+	// 6: content format, empty for posts written before markdown
+	`ALTER TABLE posts ADD COLUMN format TEXT NOT NULL DEFAULT '';
+	ALTER TABLE revisions ADD COLUMN format TEXT NOT NULL DEFAULT '';`,
+
+	// 7: comments, replies and subscribers were stored html escaped,
+	// templates escape them now
+	`UPDATE comments SET commentor = ` + unescapeSQL("commentor") + `, comment = ` + unescapeSQL("comment") + `;
+	UPDATE replies SET commentor = ` + unescapeSQL("commentor") + `, comment = ` + unescapeSQL("comment") + `;
+	UPDATE subscribers SET mail = ` + unescapeSQL("mail") + `;`,
+
+	// 8: user accounts and post authors, existing posts get theirs from
+	// ensureOwner
+	`CREATE TABLE users (
+		id        TEXT PRIMARY KEY,
+		object_id TEXT NOT NULL,
+		username  TEXT NOT NULL UNIQUE,
+		name      TEXT NOT NULL DEFAULT '',
+		bio       TEXT NOT NULL DEFAULT '',
+		password  TEXT NOT NULL,
+		role      TEXT NOT NULL,
+		created   TIMESTAMP NOT NULL
+	);
+	ALTER TABLE posts ADD COLUMN author TEXT NOT NULL DEFAULT '';
+	CREATE INDEX posts_author_published ON posts (author, published);`,
+
+	// 9: two-factor authentication
+	`ALTER TABLE users ADD COLUMN totp_secret TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN totp_enabled INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE users ADD COLUMN totp_last_step INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE users ADD COLUMN recovery_codes TEXT NOT NULL DEFAULT '[]';`,
+
+	// 10: comment moderation, existing comments and replies stay visible
+	`ALTER TABLE comments ADD COLUMN status TEXT NOT NULL DEFAULT 'approved';
+	ALTER TABLE replies ADD COLUMN status TEXT NOT NULL DEFAULT 'approved';
+	CREATE INDEX comments_status ON comments (status);
+	CREATE INDEX replies_status ON replies (status);
+
+	CREATE TABLE settings (
+		key   TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	);`,
+
+	// 11: spam filter reports and the word counts of the spam classifier
+	`ALTER TABLE comments ADD COLUMN spam_report TEXT NOT NULL DEFAULT '';
+	ALTER TABLE comments ADD COLUMN trained TEXT NOT NULL DEFAULT '';
+	ALTER TABLE replies ADD COLUMN spam_report TEXT NOT NULL DEFAULT '';
+	ALTER TABLE replies ADD COLUMN trained TEXT NOT NULL DEFAULT '';
+
+	CREATE TABLE spam_tokens (
+		token TEXT PRIMARY KEY,
+		spam  INTEGER NOT NULL DEFAULT 0,
+		ham   INTEGER NOT NULL DEFAULT 0
+	);`,
+
+	// 12: content hashes to find duplicate comments and replies, object_id
+	// starts with the creation time so it bounds their age. Existing ones
+	// get theirs from backfillContentHashes.
+	`ALTER TABLE comments ADD COLUMN content_hash TEXT NOT NULL DEFAULT '';
+	ALTER TABLE replies ADD COLUMN content_hash TEXT NOT NULL DEFAULT '';
+	CREATE INDEX comments_duplicates ON comments (belongsto, content_hash, object_id);
+	CREATE INDEX replies_duplicates ON replies (belongsto, content_hash, object_id);`,
+
+	// 13: threaded comments, replies become comments replying to the
+	// comment they belonged to
+	`ALTER TABLE comments ADD COLUMN parent_id TEXT NOT NULL DEFAULT '';
+	ALTER TABLE comments ADD COLUMN depth INTEGER NOT NULL DEFAULT 0;
+
+	INSERT INTO comments (id, object_id, belongsto, parent_id, depth, commentor, comment, status, spam_report, trained, content_hash)
+		SELECT r.object_id, r.object_id, c.belongsto, r.belongsto, 1, r.commentor, r.comment, r.status, r.spam_report, r.trained, r.content_hash
+		FROM replies r JOIN comments c ON c.id = r.belongsto
+		ORDER BY r.rowid;
+
+	DROP TABLE replies;
+	CREATE INDEX comments_parent_id ON comments (parent_id);`,
+
+	// 14: outgoing mail queue
+	`CREATE TABLE mail_jobs (
+		id           TEXT PRIMARY KEY,
+		object_id    TEXT NOT NULL,
+		kind         TEXT NOT NULL,
+		recipients   TEXT NOT NULL DEFAULT '[]',
+		subject      TEXT NOT NULL,
+		html         TEXT NOT NULL,
+		status       TEXT NOT NULL,
+		attempts     INTEGER NOT NULL DEFAULT 0,
+		last_error   TEXT NOT NULL DEFAULT '',
+		next_attempt TIMESTAMP NOT NULL,
+		created      TIMESTAMP NOT NULL,
+		sent         TIMESTAMP NOT NULL
+	);
+	CREATE INDEX mail_jobs_status_next_attempt ON mail_jobs (status, next_attempt);`,
+
+	// 15: double opt-in, subscribers are pending until they confirm their
+	// address. Those from before were never asked and stay active.
+	`ALTER TABLE subscribers ADD COLUMN status TEXT NOT NULL DEFAULT 'active';
+	ALTER TABLE subscribers ADD COLUMN created TIMESTAMP NOT NULL DEFAULT '0001-01-01 00:00:00+00:00';
+	CREATE INDEX subscribers_status_created ON subscribers (status, created);`,
+
+	// 16: subscription preferences and List-Unsubscribe headers
+	`ALTER TABLE subscribers ADD COLUMN tags TEXT NOT NULL DEFAULT '[]';
+	ALTER TABLE mail_jobs ADD COLUMN headers TEXT NOT NULL DEFAULT '{}';`,
+
+	// 17: first-time moderation trusts the browser a comment came from, not
+	// its name
+	`ALTER TABLE comments ADD COLUMN commenter TEXT NOT NULL DEFAULT '';
+	CREATE INDEX comments_commenter ON comments (commenter, status);`,
+
+	// 18: slugs of renamed posts, their links redirect to the new slug
+	`CREATE TABLE old_slugs (
+		slug   TEXT PRIMARY KEY,
+		postid TEXT NOT NULL
+	);
+	CREATE INDEX old_slugs_postid ON old_slugs (postid);`,
+
+	// 19: random tokens in the links of subscriber mails, those of the
+	// subscribers from before are made here
+	`ALTER TABLE subscribers ADD COLUMN token TEXT NOT NULL DEFAULT '';
+	UPDATE subscribers SET token = lower(hex(randomblob(16)));
+	CREATE UNIQUE INDEX subscribers_token ON subscribers (token) WHERE token != '';`,
+
+	// 20: password and role changes end the sessions of a user
+	`ALTER TABLE users ADD COLUMN session_generation INTEGER NOT NULL DEFAULT 0;`,
+}
+
+// SQL expression undoing template.HTMLEscaper on column. Released
+// migrations use it so it must never change.
+func unescapeSQL(column string) string {
+	return `replace(replace(replace(replace(replace(` + column + `, '&#34;', '"'), '&#39;', ''''), '&lt;', '<'), '&gt;', '>'), '&amp;', '&')`
+}
+
+// sqliteStore is the embedded SQLite implementation of Store
+type sqliteStore struct {
+	db *sql.DB
+}
+
+// opens (or creates) the database file at path. The schema is not touched,
+// call Migrate before using the store.
+func newSQLiteStore(path string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite3", path+"?_foreign_keys=on&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+
+	// sqlite allows a single writer, one connection avoids "database is locked"
+	db.SetMaxOpenConns(1)
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &sqliteStore{db: db}, nil
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
+
+// Migrate applies every migration newer than the current schema version and
+// returns how many were applied
+func (s *sqliteStore) Migrate() (int, error) {
+	return s.migrateTo(len(sqliteMigrations))
+}
+
+// applies the migrations newer than the current schema version up to
+// version target, tests use it to store rows of older versions
+func (s *sqliteStore) migrateTo(target int) (int, error) {
+	if _, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at TIMESTAMP NOT NULL
+	)`); err != nil {
+		return 0, err
+	}
+
+	var version int
+	if err := s.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return 0, err
+	}
+
+	applied := 0
+	for i := version; i < target; i++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return applied, err
+		}
+
+		if _, err := tx.Exec(sqliteMigrations[i]); err != nil {
+			tx.Rollback()
+			return applied, err
+		}
+
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`, i+1, time.Now().UTC()); err != nil {
+			tx.Rollback()
+			return applied, err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return applied, err
+		}
+		applied++
+	}
+
+	return applied, nil
+}
+
+const postColumns = `id, object_id, title, published, readtime, content, imagename, bptitle, bulletpoints, bqtitle, blogquote, quoteauthor, videopath, status, slug, tags, category, format, author`
+
+func (s *sqliteStore) GetPosts(filter PostFilter, skip, limit int64) ([]NewPost, error) {
+	if limit <= 0 {
+		limit = -1 // no limit
+	}
+
+	where, args := `WHERE 1 = 1`, []interface{}{}
+	if filter.PublishedOnly {
+		where += ` AND status = 'published'`
+	}
+	if filter.Tag != "" {
+		where += ` AND EXISTS (SELECT 1 FROM json_each(posts.tags) WHERE json_each.value = ?)`
+		args = append(args, filter.Tag)
+	}
+	if filter.Category != "" {
+		where += ` AND category = ?`
+		args = append(args, filter.Category)
+	}
+	if filter.Author != "" {
+		where += ` AND author = ?`
+		args = append(args, filter.Author)
+	}
+
+	args = append(args, limit, skip)
+	return s.queryPosts(`SELECT `+postColumns+` FROM posts `+where+` ORDER BY published DESC LIMIT ? OFFSET ?`, args...)
+}
+
+func (s *sqliteStore) GetTags() ([]TagCount, error) {
+	rows, err := s.db.Query(`SELECT json_each.value, COUNT(*) FROM posts, json_each(posts.tags)
+		WHERE status = 'published' GROUP BY json_each.value ORDER BY json_each.value`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []TagCount
+	for rows.Next() {
+		var tag TagCount
+		if err := rows.Scan(&tag.Name, &tag.Count); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+
+	return tags, rows.Err()
+}
+
+func (s *sqliteStore) GetDuePosts(now time.Time) ([]NewPost, error) {
+	return s.queryPosts(`SELECT `+postColumns+` FROM posts WHERE status = ? AND published <= ?`, PostScheduled, now.UTC())
+}
+
+func (s *sqliteStore) queryPosts(query string, args ...interface{}) ([]NewPost, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var posts []NewPost
+	for rows.Next() {
+		post, err := scanPost(rows)
+		if err != nil {
+			return nil, err
+		}
+		posts = append(posts, post)
+	}
+
+	return posts, rows.Err()
+}
+
+func (s *sqliteStore) GetPost(ID string) (NewPost, error) {
+	post, err := scanPost(s.db.QueryRow(`SELECT `+postColumns+` FROM posts WHERE id = ?`, ID))
+	return post, sqliteError(err)
+}
+
+func (s *sqliteStore) GetPostBySlug(slug string) (NewPost, error) {
+	post, err := scanPost(s.db.QueryRow(`SELECT `+postColumns+` FROM posts WHERE slug = ? AND slug != ''`, slug))
+	return post, sqliteError(err)
+}
+
+func (s *sqliteStore) GetPostByOldSlug(slug string) (NewPost, error) {
+	post, err := scanPost(s.db.QueryRow(`SELECT `+postColumns+` FROM posts WHERE id = (SELECT postid FROM old_slugs WHERE slug = ?)`, slug))
+	return post, sqliteError(err)
+}
+
+func (s *sqliteStore) AddOldSlug(slug, postID string) error {
+	_, err := s.db.Exec(`INSERT INTO old_slugs (slug, postid) VALUES (?, ?) ON CONFLICT (slug) DO UPDATE SET postid = excluded.postid`, slug, postID)
+	return err
+}
+
+func (s *sqliteStore) InsertPost(post NewPost) error {
+	bulletPoints, err := json.Marshal(post.BulletPoints)
+	if err != nil {
+		return err
+	}
+
+	tags, err := postTags(post)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(`INSERT INTO posts (`+postColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		post.ID, post.DatabaseID.Hex(), post.Title, post.Published.UTC(), post.ReadTime, post.Content, post.ImageName,
+		post.BpTitle, string(bulletPoints), post.BqTitle, post.BlogQuote, post.QuoteAuthor, post.VideoPath, postStatus(post), post.Slug,
+		tags, post.Category, post.Format, post.Author)
+	return err
+}
+
+func (s *sqliteStore) UpdatePost(post NewPost) error {
+	bulletPoints, err := json.Marshal(post.BulletPoints)
+	if err != nil {
+		return err
+	}
+
+	tags, err := postTags(post)
+	if err != nil {
+		return err
+	}
+
+	result, err := s.db.Exec(`UPDATE posts SET title = ?, published = ?, readtime = ?, content = ?, imagename = ?, bptitle = ?,
+		bulletpoints = ?, bqtitle = ?, blogquote = ?, quoteauthor = ?, videopath = ?, status = ?, slug = ?, tags = ?, category = ?,
+		format = ?, author = ? WHERE id = ?`,
+		post.Title, post.Published.UTC(), post.ReadTime, post.Content, post.ImageName, post.BpTitle,
+		string(bulletPoints), post.BqTitle, post.BlogQuote, post.QuoteAuthor, post.VideoPath, postStatus(post), post.Slug,
+		tags, post.Category, post.Format, post.Author, post.ID)
+	if err != nil {
+		return err
+	}
+
+	return rowsAffected(result)
+}
+
+func (s *sqliteStore) DeletePost(ID string) (DeletedPost, error) {
+	post, err := s.GetPost(ID)
+	if err != nil {
+		return DeletedPost{}, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return DeletedPost{}, err
+	}
+	defer tx.Rollback()
+
+	replies, err := tx.Exec(`DELETE FROM comments WHERE belongsto = ? AND parent_id != ''`, ID)
+	if err != nil {
+		return DeletedPost{}, err
+	}
+
+	comments, err := tx.Exec(`DELETE FROM comments WHERE belongsto = ?`, ID)
+	if err != nil {
+		return DeletedPost{}, err
+	}
+
+	revisions, err := tx.Exec(`DELETE FROM revisions WHERE postid = ?`, ID)
+	if err != nil {
+		return DeletedPost{}, err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM old_slugs WHERE postid = ?`, ID); err != nil {
+		return DeletedPost{}, err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM posts WHERE id = ?`, ID); err != nil {
+		return DeletedPost{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return DeletedPost{}, err
+	}
+
+	deleted := DeletedPost{Post: post}
+	numReplies, _ := replies.RowsAffected()
+	numComments, _ := comments.RowsAffected()
+	numRevisions, _ := revisions.RowsAffected()
+	deleted.Replies, deleted.Comments, deleted.Revisions = int(numReplies), int(numComments), int(numRevisions)
+
+	return deleted, nil
+}
+
+const revisionColumns = `id, object_id, postid, saved, editor, note, title, content, imagename, bptitle, bulletpoints, bqtitle, blogquote, quoteauthor, videopath, format`
+
+func (s *sqliteStore) GetRevisions(postID string) ([]Revision, error) {
+	rows, err := s.db.Query(`SELECT `+revisionColumns+` FROM revisions WHERE postid = ? ORDER BY saved DESC`, postID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revisions []Revision
+	for rows.Next() {
+		rev, err := scanRevision(rows)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, rev)
+	}
+
+	return revisions, rows.Err()
+}
+
+func (s *sqliteStore) GetRevision(ID string) (Revision, error) {
+	rev, err := scanRevision(s.db.QueryRow(`SELECT `+revisionColumns+` FROM revisions WHERE id = ?`, ID))
+	return rev, sqliteError(err)
+}
+
+func (s *sqliteStore) InsertRevision(rev Revision) error {
+	bulletPoints, err := json.Marshal(rev.BulletPoints)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(`INSERT INTO revisions (`+revisionColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		rev.ID, rev.DatabaseID.Hex(), rev.PostID, rev.Saved.UTC(), rev.Editor, rev.Note, rev.Title, rev.Content, rev.ImageName,
+		rev.BpTitle, string(bulletPoints), rev.BqTitle, rev.BlogQuote, rev.QuoteAuthor, rev.VideoPath, rev.Format)
+	return err
+}
+
+const commentColumns = `id, object_id, belongsto, parent_id, depth, commentor, comment, status, spam_report, trained, content_hash, commenter`
+
+func (s *sqliteStore) GetComments(postID string) ([]Comment, error) {
+	return s.queryComments(`SELECT `+commentColumns+` FROM comments WHERE belongsto = ? ORDER BY rowid`, postID)
+}
+
+func (s *sqliteStore) GetComment(ID string) (Comment, error) {
+	comments, err := s.queryComments(`SELECT `+commentColumns+` FROM comments WHERE id = ?`, ID)
+	if err != nil {
+		return Comment{}, err
+	}
+
+	if len(comments) == 0 {
+		return Comment{}, ErrNotFound
+	}
+
+	return comments[0], nil
+}
+
+func (s *sqliteStore) CountComments(postIDs []string) (map[string]int, error) {
+	counts := map[string]int{}
+	if len(postIDs) == 0 {
+		return counts, nil
+	}
+
+	args := make([]interface{}, len(postIDs))
+	for i, ID := range postIDs {
+		args[i] = ID
+	}
+
+	// walks down from the approved comments starting threads, through
+	// approved replies only. The unary + and CROSS JOIN keep sqlite on the
+	// belongsto and parent_id indexes instead of the status one.
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(postIDs)), ", ")
+	rows, err := s.db.Query(`WITH RECURSIVE visible (id, belongsto) AS (
+		SELECT id, belongsto FROM comments WHERE belongsto IN (`+placeholders+`) AND +parent_id = '' AND +status = 'approved'
+		UNION ALL
+		SELECT c.id, c.belongsto FROM visible v CROSS JOIN comments c ON c.parent_id = v.id WHERE +c.status = 'approved'
+	)
+	SELECT belongsto, COUNT(*) FROM visible GROUP BY belongsto`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var postID string
+		var count int
+		if err := rows.Scan(&postID, &count); err != nil {
+			return nil, err
+		}
+		counts[postID] = count
+	}
+
+	return counts, rows.Err()
+}
+
+func (s *sqliteStore) GetCommentsByStatus(status string) ([]Comment, error) {
+	return s.queryComments(`SELECT `+commentColumns+` FROM comments WHERE status = ? ORDER BY rowid`, status)
+}
+
+func (s *sqliteStore) InsertComment(comment Comment) error {
+	_, err := s.db.Exec(`INSERT INTO comments (`+commentColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		comment.ID, comment.DatabaseID.Hex(), comment.BelongsTo, comment.ParentID, comment.Depth, comment.Commentor, comment.Comment,
+		commentStatus(comment.Status), comment.SpamReport, comment.Trained, comment.ContentHash, comment.Commenter)
+	return err
+}
+
+func (s *sqliteStore) SetCommentStatus(ID, status, trained string) error {
+	result, err := s.db.Exec(`UPDATE comments SET status = ?, trained = ? WHERE id = ?`, status, trained, ID)
+	if err != nil {
+		return err
+	}
+
+	return rowsAffected(result)
+}
+
+func (s *sqliteStore) SetCommentHash(ID, hash string) error {
+	result, err := s.db.Exec(`UPDATE comments SET content_hash = ? WHERE id = ?`, hash, ID)
+	if err != nil {
+		return err
+	}
+
+	return rowsAffected(result)
+}
+
+func (s *sqliteStore) DeleteComment(ID string) error {
+	result, err := s.db.Exec(`WITH RECURSIVE thread (id) AS (
+			SELECT id FROM comments WHERE id = ?
+			UNION ALL
+			SELECT comments.id FROM comments JOIN thread ON comments.parent_id = thread.id
+		)
+		DELETE FROM comments WHERE id IN thread`, ID)
+	if err != nil {
+		return err
+	}
+
+	return rowsAffected(result)
+}
+
+func (s *sqliteStore) HasDuplicateComment(postID, parentID, hash string, since time.Time) (bool, error) {
+	var duplicate bool
+	err := s.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM comments WHERE belongsto = ? AND content_hash = ? AND object_id >= ? AND parent_id = ?)`,
+		postID, hash, objectIDSince(since), parentID).Scan(&duplicate)
+	return duplicate, err
+}
+
+func (s *sqliteStore) IsApprovedCommenter(key string) (bool, error) {
+	if key == "" {
+		return false, nil
+	}
+
+	var known bool
+	err := s.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM comments WHERE commenter = ? AND status = 'approved')`, key).Scan(&known)
+	return known, err
+}
+
+const subscriberColumns = `object_id, mail, status, created, tags, token`
+
+func (s *sqliteStore) GetSubscribers() ([]Subscriber, error) {
+	return s.querySubscribers(`SELECT `+subscriberColumns+` FROM subscribers WHERE status = ? ORDER BY rowid`, SubscriberActive)
+}
+
+func (s *sqliteStore) GetSubscriberByMail(mail string) (Subscriber, error) {
+	return s.getSubscriber(`SELECT `+subscriberColumns+` FROM subscribers WHERE mail = ?`, mail)
+}
+
+func (s *sqliteStore) GetSubscriberByToken(token string) (Subscriber, error) {
+	return s.getSubscriber(`SELECT `+subscriberColumns+` FROM subscribers WHERE token = ? AND token != ''`, token)
+}
+
+func (s *sqliteStore) InsertSubscriber(subscriber Subscriber) error {
+	tags, err := json.Marshal(nonNil(subscriber.Tags))
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(`INSERT INTO subscribers (`+subscriberColumns+`) VALUES (?, ?, ?, ?, ?, ?)`,
+		subscriber.DatabaseID.Hex(), subscriber.Mail, subscriberStatus(subscriber.Status), subscriber.Created.UTC(), string(tags), subscriber.Token)
+	return err
+}
+
+func (s *sqliteStore) ConfirmSubscriber(ID string) error {
+	result, err := s.db.Exec(`UPDATE subscribers SET status = ? WHERE object_id = ? AND status = ?`, SubscriberActive, ID, SubscriberPending)
+	if err != nil {
+		return err
+	}
+
+	return rowsAffected(result)
+}
+
+func (s *sqliteStore) UpdateSubscriber(sub Subscriber) error {
+	tags, err := json.Marshal(nonNil(sub.Tags))
+	if err != nil {
+		return err
+	}
+
+	result, err := s.db.Exec(`UPDATE subscribers SET mail = ?, status = ?, created = ?, tags = ?, token = ? WHERE object_id = ?`,
+		sub.Mail, subscriberStatus(sub.Status), sub.Created.UTC(), string(tags), sub.Token, sub.DatabaseID.Hex())
+	if err != nil {
+		return err
+	}
+
+	return rowsAffected(result)
+}
+
+func (s *sqliteStore) DeleteSubscriber(ID string) error {
+	result, err := s.db.Exec(`DELETE FROM subscribers WHERE object_id = ?`, ID)
+	if err != nil {
+		return err
+	}
+
+	return rowsAffected(result)
+}
+
+func (s *sqliteStore) ExpireSubscribers(before time.Time) (int, error) {
+	result, err := s.db.Exec(`DELETE FROM subscribers WHERE status = ? AND created < ?`, SubscriberPending, before.UTC())
+	if err != nil {
+		return 0, err
+	}
+
+	expired, err := result.RowsAffected()
+	return int(expired), err
+}
+
+func (s *sqliteStore) getSubscriber(query string, args ...interface{}) (Subscriber, error) {
+	subscribers, err := s.querySubscribers(query, args...)
+	if err != nil {
+		return Subscriber{}, err
+	}
+
+	if len(subscribers) == 0 {
+		return Subscriber{}, ErrNotFound
+	}
+
+	return subscribers[0], nil
+}
+
+func (s *sqliteStore) querySubscribers(query string, args ...interface{}) ([]Subscriber, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subscribers []Subscriber
+	for rows.Next() {
+		var sub Subscriber
+		var objectID, tags string
+
+		if err := rows.Scan(&objectID, &sub.Mail, &sub.Status, &sub.Created, &tags, &sub.Token); err != nil {
+			return nil, err
+		}
+		sub.DatabaseID, _ = primitive.ObjectIDFromHex(objectID)
+
+		if err := json.Unmarshal([]byte(tags), &sub.Tags); err != nil {
+			return nil, err
+		}
+
+		subscribers = append(subscribers, sub)
+	}
+
+	return subscribers, rows.Err()
+}
+
+const mailJobColumns = `id, object_id, kind, recipients, subject, html, headers, status, attempts, last_error, next_attempt, created, sent`
+
+func (s *sqliteStore) InsertMailJob(job MailJob) error {
+	recipients, headers, err := mailJobJSON(job)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(`INSERT INTO mail_jobs (`+mailJobColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		job.ID, job.DatabaseID.Hex(), job.Kind, recipients, job.Message.Subject, job.Message.HTML, headers,
+		job.Status, job.Attempts, job.LastError, job.NextAttempt.UTC(), job.Created.UTC(), job.Sent.UTC())
+	return err
+}
+
+func (s *sqliteStore) ClaimMailJobs(now, lease time.Time, limit int) ([]MailJob, error) {
+	return s.queryMailJobs(`UPDATE mail_jobs SET status = ?, next_attempt = ? WHERE id IN (
+		SELECT id FROM mail_jobs WHERE status IN (?, ?) AND next_attempt <= ? ORDER BY next_attempt LIMIT ?
+	) RETURNING `+mailJobColumns, MailSending, lease.UTC(), MailQueued, MailSending, now.UTC(), limit)
+}
+
+func (s *sqliteStore) UpdateMailJob(job MailJob) error {
+	recipients, headers, err := mailJobJSON(job)
+	if err != nil {
+		return err
+	}
+
+	result, err := s.db.Exec(`UPDATE mail_jobs SET kind = ?, recipients = ?, subject = ?, html = ?, headers = ?, status = ?, attempts = ?,
+		last_error = ?, next_attempt = ?, sent = ? WHERE id = ?`,
+		job.Kind, recipients, job.Message.Subject, job.Message.HTML, headers, job.Status, job.Attempts,
+		job.LastError, job.NextAttempt.UTC(), job.Sent.UTC(), job.ID)
+	if err != nil {
+		return err
+	}
+
+	return rowsAffected(result)
+}
+
+func (s *sqliteStore) GetMailJob(ID string) (MailJob, error) {
+	jobs, err := s.queryMailJobs(`SELECT `+mailJobColumns+` FROM mail_jobs WHERE id = ?`, ID)
+	if err != nil {
+		return MailJob{}, err
+	}
+
+	if len(jobs) == 0 {
+		return MailJob{}, ErrNotFound
+	}
+
+	return jobs[0], nil
+}
+
+func (s *sqliteStore) GetMailJobs(status string, limit int) ([]MailJob, error) {
+	return s.queryMailJobs(`SELECT `+mailJobColumns+` FROM mail_jobs WHERE status = ? ORDER BY rowid DESC LIMIT ?`, status, limit)
+}
+
+func (s *sqliteStore) CountMailJobs() (map[string]int, error) {
+	rows, err := s.db.Query(`SELECT status, COUNT(*) FROM mail_jobs GROUP BY status`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := map[string]int{}
+	for rows.Next() {
+		var status string
+		var count int
+		if err := rows.Scan(&status, &count); err != nil {
+			return nil, err
+		}
+		counts[status] = count
+	}
+
+	return counts, rows.Err()
+}
+
+func (s *sqliteStore) PurgeSentMailJobs(before time.Time) (int, error) {
+	result, err := s.db.Exec(`DELETE FROM mail_jobs WHERE status = ? AND sent < ?`, MailSent, before.UTC())
+	if err != nil {
+		return 0, err
+	}
+
+	purged, err := result.RowsAffected()
+	return int(purged), err
+}
+
+// the recipients and headers columns of job
+func mailJobJSON(job MailJob) (string, string, error) {
+	recipients, err := json.Marshal(nonNil(job.Message.To))
+	if err != nil {
+		return "", "", err
+	}
+
+	headers := job.Message.Headers
+	if headers == nil {
+		headers = map[string]string{}
+	}
+
+	encoded, err := json.Marshal(headers)
+	return string(recipients), string(encoded), err
+}
+
+func (s *sqliteStore) queryMailJobs(query string, args ...interface{}) ([]MailJob, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []MailJob
+	for rows.Next() {
+		var job MailJob
+		var objectID, recipients, headers string
+
+		err := rows.Scan(&job.ID, &objectID, &job.Kind, &recipients, &job.Message.Subject, &job.Message.HTML, &headers,
+			&job.Status, &job.Attempts, &job.LastError, &job.NextAttempt, &job.Created, &job.Sent)
+		if err != nil {
+			return nil, err
+		}
+
+		job.DatabaseID, _ = primitive.ObjectIDFromHex(objectID)
+
+		if err := json.Unmarshal([]byte(recipients), &job.Message.To); err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal([]byte(headers), &job.Message.Headers); err != nil {
+			return nil, err
+		}
+
+		jobs = append(jobs, job)
+	}
+
+	return jobs, rows.Err()
+}
+
+const userColumns = `id, object_id, username, name, bio, password, role, created, totp_secret, totp_enabled, totp_last_step, recovery_codes, session_generation`
+
+func (s *sqliteStore) GetUsers() ([]User, error) {
+	rows, err := s.db.Query(`SELECT ` + userColumns + ` FROM users ORDER BY username`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+func (s *sqliteStore) GetUser(ID string) (User, error) {
+	user, err := scanUser(s.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, ID))
+	return user, sqliteError(err)
+}
+
+func (s *sqliteStore) GetUserByName(username string) (User, error) {
+	user, err := scanUser(s.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE username = ?`, username))
+	return user, sqliteError(err)
+}
+
+func (s *sqliteStore) InsertUser(user User) error {
+	recoveryCodes, err := json.Marshal(nonNil(user.RecoveryCodes))
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(`INSERT INTO users (`+userColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		user.ID, user.DatabaseID.Hex(), user.Username, user.Name, user.Bio, user.PasswordHash, user.Role, user.Created.UTC(),
+		user.TOTPSecret, user.TOTPEnabled, user.TOTPLastStep, string(recoveryCodes), user.SessionGeneration)
+	return err
+}
+
+func (s *sqliteStore) UpdateUser(user User) error {
+	recoveryCodes, err := json.Marshal(nonNil(user.RecoveryCodes))
+	if err != nil {
+		return err
+	}
+
+	result, err := s.db.Exec(`UPDATE users SET username = ?, name = ?, bio = ?, password = ?, role = ?, totp_secret = ?,
+		totp_enabled = ?, totp_last_step = ?, recovery_codes = ?, session_generation = ? WHERE id = ?`,
+		user.Username, user.Name, user.Bio, user.PasswordHash, user.Role, user.TOTPSecret,
+		user.TOTPEnabled, user.TOTPLastStep, string(recoveryCodes), user.SessionGeneration, user.ID)
+	if err != nil {
+		return err
+	}
+
+	return rowsAffected(result)
+}
+
+func (s *sqliteStore) DeleteUser(ID string) error {
+	result, err := s.db.Exec(`DELETE FROM users WHERE id = ?`, ID)
+	if err != nil {
+		return err
+	}
+
+	return rowsAffected(result)
+}
+
+func (s *sqliteStore) GetSetting(key string) (string, error) {
+	var value string
+	err := s.db.QueryRow(`SELECT value FROM settings WHERE key = ?`, key).Scan(&value)
+	return value, sqliteError(err)
+}
+
+func (s *sqliteStore) SetSetting(key, value string) error {
+	_, err := s.db.Exec(`INSERT INTO settings (key, value) VALUES (?, ?) ON CONFLICT (key) DO UPDATE SET value = excluded.value`, key, value)
+	return err
+}
+
+// sqlite limits the number of parameters of a statement, long messages are
+// looked up in batches
+const spamTokenBatch = 500
+
+func (s *sqliteStore) GetSpamTokens(tokens []string) (map[string]SpamToken, error) {
+	counts := map[string]SpamToken{}
+
+	for start := 0; start < len(tokens); start += spamTokenBatch {
+		end := start + spamTokenBatch
+		if end > len(tokens) {
+			end = len(tokens)
+		}
+
+		batch := tokens[start:end]
+		args := make([]interface{}, len(batch))
+		for i, token := range batch {
+			args[i] = token
+		}
+
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(batch)), ", ")
+		rows, err := s.db.Query(`SELECT token, spam, ham FROM spam_tokens WHERE token IN (`+placeholders+`)`, args...)
+		if err != nil {
+			return nil, err
+		}
+
+		for rows.Next() {
+			var count SpamToken
+			if err := rows.Scan(&count.Token, &count.Spam, &count.Ham); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			counts[count.Token] = count
+		}
+
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return counts, nil
+}
+
+func (s *sqliteStore) AddSpamTokens(tokens []string, spam, ham int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`INSERT INTO spam_tokens (token, spam, ham) VALUES (?, MAX(?, 0), MAX(?, 0))
+		ON CONFLICT (token) DO UPDATE SET spam = MAX(spam + ?, 0), ham = MAX(ham + ?, 0)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, token := range tokens {
+		if _, err := stmt.Exec(token, spam, ham, spam, ham); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteStore) queryComments(query string, args ...interface{}) ([]Comment, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var comments []Comment
+	for rows.Next() {
+		var comment Comment
+		var objectID string
+
+		if err := rows.Scan(&comment.ID, &objectID, &comment.BelongsTo, &comment.ParentID, &comment.Depth, &comment.Commentor,
+			&comment.Comment, &comment.Status, &comment.SpamReport, &comment.Trained, &comment.ContentHash, &comment.Commenter); err != nil {
+			return nil, err
+		}
+		comment.DatabaseID, _ = primitive.ObjectIDFromHex(objectID)
+
+		comments = append(comments, comment)
+	}
+
+	return comments, rows.Err()
+}
+
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanPost(row rowScanner) (NewPost, error) {
+	var post NewPost
+	var objectID, bulletPoints, tags string
+
+	err := row.Scan(&post.ID, &objectID, &post.Title, &post.Published, &post.ReadTime, &post.Content, &post.ImageName,
+		&post.BpTitle, &bulletPoints, &post.BqTitle, &post.BlogQuote, &post.QuoteAuthor, &post.VideoPath, &post.Status, &post.Slug,
+		&tags, &post.Category, &post.Format, &post.Author)
+	if err != nil {
+		return NewPost{}, err
+	}
+
+	post.DatabaseID, _ = primitive.ObjectIDFromHex(objectID)
+	post.Comments = []Comment{}
+
+	if err := json.Unmarshal([]byte(bulletPoints), &post.BulletPoints); err != nil {
+		return NewPost{}, err
+	}
+
+	if err := json.Unmarshal([]byte(tags), &post.Tags); err != nil {
+		return NewPost{}, err
+	}
+
+	return post, nil
+}
+
+func scanRevision(row rowScanner) (Revision, error) {
+	var rev Revision
+	var objectID, bulletPoints string
+
+	err := row.Scan(&rev.ID, &objectID, &rev.PostID, &rev.Saved, &rev.Editor, &rev.Note, &rev.Title, &rev.Content, &rev.ImageName,
+		&rev.BpTitle, &bulletPoints, &rev.BqTitle, &rev.BlogQuote, &rev.QuoteAuthor, &rev.VideoPath, &rev.Format)
+	if err != nil {
+		return Revision{}, err
+	}
+
+	rev.DatabaseID, _ = primitive.ObjectIDFromHex(objectID)
+
+	if err := json.Unmarshal([]byte(bulletPoints), &rev.BulletPoints); err != nil {
+		return Revision{}, err
+	}
+
+	return rev, nil
+}
+
+func scanUser(row rowScanner) (User, error) {
+	var user User
+	var objectID, recoveryCodes string
+
+	err := row.Scan(&user.ID, &objectID, &user.Username, &user.Name, &user.Bio, &user.PasswordHash, &user.Role, &user.Created,
+		&user.TOTPSecret, &user.TOTPEnabled, &user.TOTPLastStep, &recoveryCodes, &user.SessionGeneration)
+	if err != nil {
+		return User{}, err
+	}
+
+	user.DatabaseID, _ = primitive.ObjectIDFromHex(objectID)
+
+	if err := json.Unmarshal([]byte(recoveryCodes), &user.RecoveryCodes); err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+// the status column is never empty, posts without one are published
+func postStatus(post NewPost) string {
+	if post.Status == "" {
+		return PostPublished
+	}
+	return post.Status
+}
+
+// the status column of comments is never empty, those without
+// one are approved
+func commentStatus(status string) string {
+	if status == "" {
+		return CommentApproved
+	}
+	return status
+}
+
+// the status column of subscribers is never empty either, those without one
+// are active
+func subscriberStatus(status string) string {
+	if status == "" {
+		return SubscriberActive
+	}
+	return status
+}
+
+// lowest object_id created at since or later, hex ids sort like their
+// timestamps. Every id is at least "".
+func objectIDSince(since time.Time) string {
+	if since.IsZero() {
+		return ""
+	}
+	return primitive.NewObjectIDFromTimestamp(since).Hex()
+}
+
+// tags of post as a json array, never null so json_each always sees an array
+func postTags(post NewPost) (string, error) {
+	if post.Tags == nil {
+		return "[]", nil
+	}
+
+	tags, err := json.Marshal(post.Tags)
+	return string(tags), err
+}
+
+// json arrays are stored as [] rather than null
+func nonNil(list []string) []string {
+	if list == nil {
+		return []string{}
+	}
+	return list
+}
+
+// returns ErrNotFound if a statement did not change any row
+func rowsAffected(result sql.Result) error {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// maps database/sql errors to store errors
+func sqliteError(err error) error {
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSQLiteMigrateKeepsData(t *testing.T) {
+	store, err := newSQLiteStore(filepath.Join(t.TempDir(), "old.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	// a database of the first release, comments were stored html escaped
+	if _, err := store.migrateTo(1); err != nil {
+		t.Fatal(err)
+	}
+
+	published := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	seed := []struct {
+		query string
+		args  []interface{}
+	}{
+		{`INSERT INTO posts (id, object_id, title, published, content) VALUES (?, ?, ?, ?, ?)`,
+			[]interface{}{"p1", "604ca0000000000000000001", "Hello, World", published, "<p>First post</p>"}},
+		{`INSERT INTO comments (id, object_id, belongsto, commentor, comment) VALUES (?, ?, ?, ?, ?)`,
+			[]interface{}{"c1", "604ca0000000000000000002", "p1", "Ada", "Tom &amp; Jerry &lt;3"}},
+		{`INSERT INTO replies (object_id, belongsto, commentor, comment) VALUES (?, ?, ?, ?)`,
+			[]interface{}{"604ca0000000000000000003", "c1", "Bob", "I &#39;agree&#39;"}},
+		{`INSERT INTO subscribers (object_id, mail) VALUES (?, ?)`,
+			[]interface{}{"604ca0000000000000000004", "reader@example.com"}},
+	}
+	for _, row := range seed {
+		if _, err := store.db.Exec(row.query, row.args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	applied, err := store.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if applied != len(sqliteMigrations)-1 {
+		t.Fatalf("applied %d migrations, want %d", applied, len(sqliteMigrations)-1)
+	}
+
+	// slugs and content hashes are filled in outside the sql migrations
+	if _, err := migrateStore(store); err != nil {
+		t.Fatal(err)
+	}
+
+	post, err := store.GetPost("p1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if post.Title != "Hello, World" || post.Content != "<p>First post</p>" || !post.Published.Equal(published) {
+		t.Errorf("got post %+v", post)
+	}
+	if !post.IsPublished() || post.Slug != "hello-world" || post.Format != FormatLegacy {
+		t.Errorf("got status %q, slug %q, format %q", post.Status, post.Slug, post.Format)
+	}
+
+	comments, err := store.GetComments("p1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(comments) != 2 {
+		t.Fatalf("got %d comments, want the comment and the reply", len(comments))
+	}
+
+	comment, reply := comments[0], comments[1]
+	if comment.ID != "c1" || comment.Comment != "Tom & Jerry <3" || comment.ParentID != "" || !comment.IsApproved() {
+		t.Errorf("got comment %+v", comment)
+	}
+	if reply.Comment != "I 'agree'" || reply.ParentID != "c1" || reply.Depth != 1 || reply.BelongsTo != "p1" || !reply.IsApproved() {
+		t.Errorf("got reply %+v", reply)
+	}
+	for _, c := range comments {
+		if c.ContentHash != contentHash(c.Commentor, c.Comment) {
+			t.Errorf("comment %s has content hash %q", c.ID, c.ContentHash)
+		}
+	}
+
+	counts, err := store.CountComments([]string{"p1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts["p1"] != 2 {
+		t.Errorf("counted %d comments, want 2", counts["p1"])
+	}
+
+	sub, err := store.GetSubscriberByMail("reader@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sub.IsActive() || sub.Token == "" {
+		t.Errorf("got subscriber %+v, want an active one with a token", sub)
+	}
+
+	// nothing left to apply
+	if applied, err := store.Migrate(); err != nil || applied != 0 {
+		t.Fatalf("second migrate: applied %d, error %v, want 0", applied, err)
+	}
+	if applied, err := migrateStore(store); err != nil || applied != 0 {
+		t.Fatalf("second migrateStore: applied %d, error %v, want 0", applied, err)
+	}
+}
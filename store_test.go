@@ -0,0 +1,157 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// size of the seeded stores, a home page shows a handful of posts but the
+// admin lists show them all
+const (
+	benchPosts    = 50
+	benchThreads  = 10 // comments starting a thread on each post
+	benchReplies  = 3  // replies to each of them
+	benchNestings = 2  // replies to each reply
+)
+
+// fills store with posts and comment threads in every moderation status,
+// returns the IDs of the posts
+func seedComments(b *testing.B, store Store) []string {
+	b.Helper()
+
+	statuses := []string{CommentApproved, CommentApproved, CommentPending, CommentSpam, ""}
+	next := 0
+	comment := func(postID, parentID string, depth int) string {
+		next++
+		c := Comment{
+			DatabaseID: primitive.NewObjectID(),
+			ID:         "c" + strconv.Itoa(next),
+			BelongsTo:  postID,
+			ParentID:   parentID,
+			Depth:      depth,
+			Commentor:  "reader",
+			Comment:    "a comment",
+			Status:     statuses[next%len(statuses)],
+		}
+		if err := store.InsertComment(c); err != nil {
+			b.Fatal("inserting comment: " + err.Error())
+		}
+		return c.ID
+	}
+
+	var postIDs []string
+	for i := 0; i < benchPosts; i++ {
+		post := NewPost{
+			DatabaseID: primitive.NewObjectID(),
+			ID:         "p" + strconv.Itoa(i),
+			Title:      "Post " + strconv.Itoa(i),
+			Slug:       "post-" + strconv.Itoa(i),
+			Published:  time.Now(),
+			Content:    "content",
+			Status:     PostPublished,
+		}
+		if err := store.InsertPost(post); err != nil {
+			b.Fatal("inserting post: " + err.Error())
+		}
+		postIDs = append(postIDs, post.ID)
+
+		for t := 0; t < benchThreads; t++ {
+			thread := comment(post.ID, "", 0)
+			for r := 0; r < benchReplies; r++ {
+				reply := comment(post.ID, thread, 1)
+				for n := 0; n < benchNestings; n++ {
+					comment(post.ID, reply, 2)
+				}
+			}
+		}
+	}
+
+	return postIDs
+}
+
+// the home page before CountComments: every post's comments were loaded and
+// threaded to count the ones readers see
+func countPerPost(store Store, postIDs []string) (map[string]int, error) {
+	counts := map[string]int{}
+	for _, ID := range postIDs {
+		comments, err := store.GetComments(ID)
+		if err != nil {
+			return nil, err
+		}
+		if count := countComments(commentThreads(comments)); count > 0 {
+			counts[ID] = count
+		}
+	}
+	return counts, nil
+}
+
+func benchmarkCountComments(b *testing.B, store Store) {
+	postIDs := seedComments(b, store)
+
+	// both ways must agree before their speed means anything
+	aggregated, err := store.CountComments(postIDs)
+	if err != nil {
+		b.Fatal(err)
+	}
+	perPost, err := countPerPost(store, postIDs)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, ID := range postIDs {
+		if aggregated[ID] != perPost[ID] {
+			b.Fatalf("post %s: CountComments gives %d, threading gives %d", ID, aggregated[ID], perPost[ID])
+		}
+	}
+
+	b.Run("aggregated", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := store.CountComments(postIDs); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("per-post", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := countPerPost(store, postIDs); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkCountCommentsMemory(b *testing.B) {
+	benchmarkCountComments(b, newMemoryStore())
+}
+
+func BenchmarkCountCommentsSQLite(b *testing.B) {
+	benchmarkCountComments(b, newTestSQLiteStore(b))
+}
+
+// migrated sqlite store in a temporary file, closed when the test ends
+func newTestSQLiteStore(tb testing.TB) *sqliteStore {
+	tb.Helper()
+
+	store, err := newSQLiteStore(filepath.Join(tb.TempDir(), "test.db"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { store.Close() })
+
+	if _, err := store.Migrate(); err != nil {
+		tb.Fatal("migrating: " + err.Error())
+	}
+
+	return store
+}
+
+// runs test on each store that works without a server. Mongo is left out,
+// its store always uses the database of the site.
+func forEachStore(t *testing.T, test func(t *testing.T, store Store)) {
+	t.Run("memory", func(t *testing.T) { test(t, newMemoryStore()) })
+	t.Run("sqlite", func(t *testing.T) { test(t, newTestSQLiteStore(t)) })
+}
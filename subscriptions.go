@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// statuses of subscribers. Those stored before double opt-in existed have
+// none and count as active.
+const (
+	SubscriberPending = "pending" // has not confirmed the address yet
+	SubscriberActive  = "active"
+)
+
+// how long a new subscriber has to confirm, after that the link expires
+// and the subscriber is deleted
+const subscriberConfirmTime = 48 * time.Hour
+
+// reports if sub gets mails about new posts
+func (sub Subscriber) IsActive() bool {
+	return sub.Status == "" || sub.Status == SubscriberActive
+}
+
+// address of the blog in mails, from the siteURL environment variable
+func siteURL() string {
+	if url := os.Getenv("siteURL"); url != "" {
+		return strings.TrimSuffix(url, "/")
+	}
+	return "http://needrimasblog.herokuapp.com"
+}
+
+// reports if sub wants a mail about post
+func (sub Subscriber) WantsPost(post NewPost) bool {
+	if len(sub.Tags) == 0 {
+		return true
+	}
+
+	for _, tag := range post.Tags {
+		if Found(sub.Tags, tag) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// page where sub manages their subscription
+func (s *Server) subscriptionURL(sub Subscriber) string {
+	return siteURL() + "/subscription/" + sub.Token
+}
+
+// queues a mail to sub with a link to their subscription page at the end,
+// and the List-Unsubscribe headers of RFC 8058 so mail clients can offer
+// to unsubscribe in one click
+func (s *Server) queueSubscriberMail(kind string, sub Subscriber, subject, html string) error {
+	link := s.subscriptionURL(sub)
+
+	return s.queueMail(kind, Message{
+		To:      []string{sub.Mail},
+		Subject: subject,
+		HTML: html + `<p style="color:gray;font-size:small;">You get this mail because this address subscribed to Needrima's blog. <a style="color:gray;" href="` +
+			link + `">Unsubscribe or choose the posts you get</a></p>`,
+		Headers: map[string]string{
+			"List-Unsubscribe":      "<" + link + ">",
+			"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+		},
+	})
+}
+
+// reports if r is the one-click unsubscribe of RFC 8058, which mail
+// clients post without a CSRF token. The token in the link authorizes it.
+func isOneClickUnsubscribe(r *http.Request) bool {
+	return r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/subscription/") &&
+		r.PostFormValue("List-Unsubscribe") == "One-Click"
+}
+
+// data of the subscription page
+type SubscriptionPage struct {
+	Mail         string
+	Pending      bool // not confirmed yet
+	Unsubscribed bool
+	Tags         []string        // of the blog
+	Chosen       map[string]bool // tags the subscriber gets mails about
+	Message      string
+}
+
+// lets a subscriber who followed the link in a mail unsubscribe or choose
+// the tags of the posts they get mails about. Mail scanners open links, so
+// GET never changes anything.
+func (s *Server) Subscription(w http.ResponseWriter, r *http.Request) {
+	if !ValidMethod(r) {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sub, err := s.store.GetSubscriberByToken(r.URL.Path[len("/subscription/"):])
+	if err != nil && err != ErrNotFound {
+		http.Error(w, "Finding subscriber: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// tokens are deleted with their subscriber, an unknown one was
+	// unsubscribed already
+	if err == ErrNotFound {
+		if isOneClickUnsubscribe(r) {
+			fmt.Fprintln(w, "Unsubscribed")
+			return
+		}
+
+		templates(r).ExecuteTemplate(w, "subscription.html", SubscriptionPage{Unsubscribed: true})
+		return
+	}
+
+	ID := sub.DatabaseID.Hex()
+
+	if isOneClickUnsubscribe(r) {
+		if err := s.store.DeleteSubscriber(ID); err != nil && err != ErrNotFound {
+			http.Error(w, "Unsubscribing: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintln(w, "Unsubscribed")
+		return
+	}
+
+	tags, err := s.store.GetTags()
+	if err != nil {
+		http.Error(w, "Finding tags: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := SubscriptionPage{Mail: sub.Mail, Pending: !sub.IsActive(), Chosen: map[string]bool{}}
+	for _, tag := range tags {
+		data.Tags = append(data.Tags, tag.Name)
+	}
+
+	if r.Method == http.MethodPost {
+		r.ParseForm()
+
+		switch action := r.FormValue("action"); action {
+		case "unsubscribe":
+			if err := s.store.DeleteSubscriber(ID); err != nil && err != ErrNotFound {
+				http.Error(w, "Unsubscribing: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			templates(r).ExecuteTemplate(w, "subscription.html", SubscriptionPage{Mail: sub.Mail, Unsubscribed: true})
+			return
+		case "save":
+			// tags no post has are dropped, they would never match
+			sub.Tags = nil
+			for _, tag := range r.Form["tag"] {
+				if Found(data.Tags, tag) && !Found(sub.Tags, tag) {
+					sub.Tags = append(sub.Tags, tag)
+				}
+			}
+
+			if err := s.store.UpdateSubscriber(sub); err != nil {
+				http.Error(w, "Saving subscription: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			data.Message = "Your choice is saved"
+		default:
+			http.Error(w, "Unknown action "+action, http.StatusBadRequest)
+			return
+		}
+	}
+
+	for _, tag := range sub.Tags {
+		data.Chosen[tag] = true
+	}
+
+	templates(r).ExecuteTemplate(w, "subscription.html", data)
+}
+
+// random token of a new subscriber, for the links in their mails. It is
+// kept with the subscriber, so links keep working across restarts and
+// changes of sessionSecret.
+func newSubscriberToken() string {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		log.Fatal("subscriber token: " + err.Error())
+	}
+	return hex.EncodeToString(random)
+}
+
+// reports if the confirmation link of sub still works at now
+func (sub Subscriber) canConfirm(now time.Time) bool {
+	return now.Before(sub.Created.Add(subscriberConfirmTime))
+}
+
+// queues the mail asking a new subscriber to confirm their address
+func (s *Server) sendConfirmMail(sub Subscriber) error {
+	link := siteURL() + "/subscribe/confirm?token=" + sub.Token
+
+	err := s.queueSubscriberMail("confirm", sub, "Confirm your subscription to Needrima's Blog",
+		`Someone, hopefully you, subscribed this address to Needrima's blog. <a style="color:red;" href="`+link+`">Confirm your subscription</a> within `+
+			strconv.Itoa(int(subscriberConfirmTime.Hours()))+` hours to get a mail about every new post. If it was not you, ignore this mail and you will not hear from us again.`)
+	if err != nil {
+		return errors.New("queueing confirmation message failed: " + err.Error())
+	}
+
+	return nil
+}
+
+// data of the subscription confirmation page
+type ConfirmSubscriptionPage struct {
+	Mail      string
+	Confirmed bool
+	Expired   bool
+}
+
+// confirms the address of a new subscriber who followed the link in the
+// confirmation mail, and welcomes them. Like Subscription, GET only asks.
+func (s *Server) ConfirmSubscription(w http.ResponseWriter, r *http.Request) {
+	if !ValidMethod(r) {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sub, err := s.store.GetSubscriberByToken(r.FormValue("token"))
+	if err != nil && err != ErrNotFound {
+		http.Error(w, "Finding subscriber: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// expired, or unsubscribed again
+	if err == ErrNotFound || (!sub.IsActive() && !sub.canConfirm(time.Now())) {
+		templates(r).ExecuteTemplate(w, "subscribe-confirm.html", ConfirmSubscriptionPage{Expired: true})
+		return
+	}
+
+	data := ConfirmSubscriptionPage{Mail: sub.Mail, Confirmed: sub.IsActive()}
+
+	if r.Method == http.MethodPost && !data.Confirmed {
+		if err := s.store.ConfirmSubscriber(sub.DatabaseID.Hex()); err != nil {
+			http.Error(w, "Confirming: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data.Confirmed = true
+
+		if err := s.sendWelcomeMail(sub); err != nil {
+			log.Println(err)
+		}
+	}
+
+	templates(r).ExecuteTemplate(w, "subscribe-confirm.html", data)
+}
+
+// deletes the subscribers who did not confirm in time
+func (s *Server) expireSubscribers(now time.Time) {
+	expired, err := s.store.ExpireSubscribers(now.Add(-subscriberConfirmTime))
+	if err != nil {
+		log.Println("Expiring subscribers:", err)
+		return
+	}
+
+	if expired > 0 {
+		log.Println("Deleted", expired, "unconfirmed subscribers")
+	}
+}
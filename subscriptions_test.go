@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// stores a subscriber with a fresh token and returns it
+func addTestSubscriber(t *testing.T, store Store, mail, status string, created time.Time) Subscriber {
+	t.Helper()
+
+	sub := Subscriber{DatabaseID: primitive.NewObjectID(), Mail: mail, Status: status, Created: created, Token: newSubscriberToken()}
+	if err := store.InsertSubscriber(sub); err != nil {
+		t.Fatal(err)
+	}
+
+	return sub
+}
+
+// status of the subscriber with mail, "deleted" when there is none
+func storedSubscriberStatus(t *testing.T, store Store, mail string) string {
+	t.Helper()
+
+	sub, err := store.GetSubscriberByMail(mail)
+	if err == ErrNotFound {
+		return "deleted"
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sub.Status
+}
+
+func TestConfirmSubscription(t *testing.T) {
+	s := newTestServer(t)
+	c := newTestClient(t, s)
+
+	sub := addTestSubscriber(t, s.store, "reader@example.com", SubscriberPending, time.Now())
+
+	for _, token := range []string{"", "wrong", sub.Token[1:]} {
+		path := "/subscribe/confirm?token=" + url.QueryEscape(token)
+		assertBody(t, c.get(path), "This link has expired")
+		assertBody(t, c.post(path, url.Values{}), "This link has expired")
+	}
+	if status := storedSubscriberStatus(t, s.store, sub.Mail); status != SubscriberPending {
+		t.Fatalf("after wrong tokens: got %s, want %s", status, SubscriberPending)
+	}
+
+	// mail scanners open links, only the button confirms
+	path := "/subscribe/confirm?token=" + sub.Token
+	w := c.get(path)
+	assertStatus(t, w, http.StatusOK)
+	assertBody(t, w, "Subscribe reader@example.com?")
+	if status := storedSubscriberStatus(t, s.store, sub.Mail); status != SubscriberPending {
+		t.Fatalf("after opening the link: got %s, want %s", status, SubscriberPending)
+	}
+
+	w = c.post(path, url.Values{})
+	assertStatus(t, w, http.StatusOK)
+	assertBody(t, w, "You are subscribed")
+	if status := storedSubscriberStatus(t, s.store, sub.Mail); status != SubscriberActive {
+		t.Fatalf("after confirming: got %s, want %s", status, SubscriberActive)
+	}
+
+	jobs, err := s.store.GetMailJobs(MailQueued, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].Kind != "welcome" {
+		t.Fatalf("got mail jobs %+v, want the welcome mail", jobs)
+	}
+
+	// the link keeps saying so, without a second welcome mail
+	assertBody(t, c.post(path, url.Values{}), "You are subscribed")
+	if jobs, _ := s.store.GetMailJobs(MailQueued, 10); len(jobs) != 1 {
+		t.Fatalf("got %d mail jobs after confirming twice, want 1", len(jobs))
+	}
+}
+
+func TestConfirmExpiredSubscription(t *testing.T) {
+	s := newTestServer(t)
+	c := newTestClient(t, s)
+
+	sub := addTestSubscriber(t, s.store, "late@example.com", SubscriberPending, time.Now().Add(-subscriberConfirmTime-time.Minute))
+
+	path := "/subscribe/confirm?token=" + sub.Token
+	assertBody(t, c.get(path), "This link has expired")
+	assertBody(t, c.post(path, url.Values{}), "This link has expired")
+	if status := storedSubscriberStatus(t, s.store, sub.Mail); status != SubscriberPending {
+		t.Fatalf("got %s, want %s", status, SubscriberPending)
+	}
+}
+
+func TestExpireSubscribers(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+		old := now.Add(-subscriberConfirmTime - time.Minute)
+
+		addTestSubscriber(t, store, "late@example.com", SubscriberPending, old)
+		addTestSubscriber(t, store, "new@example.com", SubscriberPending, now.Add(-time.Hour))
+		addTestSubscriber(t, store, "active@example.com", SubscriberActive, old)
+
+		s := &Server{store: store}
+		s.expireSubscribers(now)
+
+		want := map[string]string{
+			"late@example.com":   "deleted",
+			"new@example.com":    SubscriberPending,
+			"active@example.com": SubscriberActive,
+		}
+		for mail, status := range want {
+			if got := storedSubscriberStatus(t, store, mail); got != status {
+				t.Errorf("%s: got %s, want %s", mail, got, status)
+			}
+		}
+	})
+}
+
+func TestOneClickUnsubscribe(t *testing.T) {
+	s := newTestServer(t)
+
+	sub := addTestSubscriber(t, s.store, "reader@example.com", SubscriberActive, time.Now())
+	path := "/subscription/" + sub.Token
+
+	// a mail client, without cookies or a csrf token
+	client := newTestClient(t, s)
+
+	// other posts still need the token
+	assertStatus(t, client.postRaw(path, url.Values{"action": {"unsubscribe"}}), http.StatusForbidden)
+	if status := storedSubscriberStatus(t, s.store, sub.Mail); status != SubscriberActive {
+		t.Fatalf("after a post without a token: got %s, want %s", status, SubscriberActive)
+	}
+
+	// opening the link changes nothing
+	w := client.get(path)
+	assertStatus(t, w, http.StatusOK)
+	assertBody(t, w, "Subscription of reader@example.com")
+
+	oneClick := url.Values{"List-Unsubscribe": {"One-Click"}}
+	w = newTestClient(t, s).postRaw(path, oneClick)
+	assertStatus(t, w, http.StatusOK)
+	assertBody(t, w, "Unsubscribed")
+	if status := storedSubscriberStatus(t, s.store, sub.Mail); status != "deleted" {
+		t.Fatalf("after one click: got %s, want deleted", status)
+	}
+
+	// mail clients may post again
+	w = newTestClient(t, s).postRaw(path, oneClick)
+	assertStatus(t, w, http.StatusOK)
+	assertBody(t, w, "Unsubscribed")
+
+	assertBody(t, client.get(path), "You are unsubscribed")
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// lists the published posts with a tag, /tag/{name}?page=N
+func (s *Server) TagPosts(w http.ResponseWriter, r *http.Request) {
+	tag := r.URL.Path[len("/tag/"):]
+
+	s.listPosts(w, r, PostFilter{PublishedOnly: true, Tag: tag}, "Posts tagged "+tag)
+}
+
+// lists the published posts of a category, /category/{name}?page=N
+func (s *Server) CategoryPosts(w http.ResponseWriter, r *http.Request) {
+	category := r.URL.Path[len("/category/"):]
+
+	s.listPosts(w, r, PostFilter{PublishedOnly: true, Category: category}, "Posts in "+category)
+}
+
+// renders eight posts matching filter per page, like Home does
+func (s *Server) listPosts(w http.ResponseWriter, r *http.Request, filter PostFilter, heading string) {
+	if !ValidMethod(r) {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if filter.Tag == "" && filter.Category == "" {
+		templates(r).ExecuteTemplate(w, "page-end.html", nil)
+		return
+	}
+
+	pageNumber, _ := strconv.Atoi(r.FormValue("page"))
+	if pageNumber < 0 {
+		pageNumber = 0
+	}
+
+	limit, skip := int64(8), int64(8*pageNumber)
+	posts, err := s.store.GetPosts(filter, skip, limit)
+	if err != nil {
+		http.Error(w, "Find: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// past the last page
+	if len(posts) == 0 && pageNumber > 0 {
+		http.Redirect(w, r, r.URL.Path+"?page="+strconv.Itoa(pageNumber-1), http.StatusSeeOther)
+		return
+	}
+
+	// unknown tag or category
+	if len(posts) == 0 {
+		templates(r).ExecuteTemplate(w, "page-end.html", nil)
+		return
+	}
+
+	data := BlogPostAndPageNumber{
+		BlogPosts:  s.getBlogPosts(posts),
+		PageNumber: pageNumber,
+		Heading:    heading,
+		ListPath:   r.URL.Path,
+	}
+
+	s.renderIndex(w, r, data)
+}
+
+// tags with their post counts and the font size (percent) they get in the
+// tag cloud, failures only leave the cloud empty
+func (s *Server) tagCloud() []TagCount {
+	tags, err := s.store.GetTags()
+	if err != nil {
+		log.Println("Finding tags:", err)
+		return nil
+	}
+
+	most := 1
+	for _, tag := range tags {
+		if tag.Count > most {
+			most = tag.Count
+		}
+	}
+
+	for i := range tags {
+		tags[i].Size = 80 + 80*tags[i].Count/most
+	}
+
+	return tags
+}
+
+// splits the comma separated tags of the post form, each one made url safe
+// the same way slugs are
+func parseTags(input string) []string {
+	tags := []string{}
+
+	for _, name := range strings.Split(input, ",") {
+		tag := slugify(name)
+		if tag != "" && !Found(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+
+	return tags
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+const (
+	// RFC 6238 defaults, the only ones every authenticator app supports
+	totpDigits = 6
+	totpPeriod = 30 // seconds
+
+	// codes of the previous and next period are accepted too, for clock drift
+	totpSkew = 1
+
+	totpIssuer = "Needrima's Blog"
+
+	// how long the code form may take after the password was accepted
+	totpLoginTimeout = 5 * time.Minute
+	totpCookie       = "login2fa"
+
+	numRecoveryCodes = 10
+)
+
+var (
+	errBadCode = errors.New("wrong code")
+
+	base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// random secret shared with the authenticator app, base32 as apps expect it
+func newTOTPSecret() (string, error) {
+	secret := make([]byte, 20) // 160 bits, the RFC 4226 recommendation
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+
+	return base32NoPadding.EncodeToString(secret), nil
+}
+
+// code of secret for the time step (RFC 4226 HOTP with the step as counter)
+func totpCode(secret string, step int64) (string, error) {
+	key, err := base32NoPadding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	// dynamic truncation
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", totpDigits, value%mod), nil
+}
+
+// checks code against secret at now. It returns the matched time step, which
+// must be newer than lastStep so a code is never accepted twice.
+func verifyTOTP(secret, code string, lastStep int64, now time.Time) (int64, bool) {
+	code = strings.Join(strings.Fields(code), "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+// otpauth URI of the key, what the QR code holds
+func totpURI(username, secret string) string {
+	values := url.Values{}
+	values.Set("secret", secret)
+	values.Set("issuer", totpIssuer)
+	values.Set("digits", strconv.Itoa(totpDigits))
+	values.Set("period", strconv.Itoa(totpPeriod))
+
+	label := url.PathEscape(totpIssuer + ":" + username)
+	// some apps show a + literally, %20 works everywhere
+	return "otpauth://totp/" + label + "?" + strings.Replace(values.Encode(), "+", "%20", -1)
+}
+
+// QR code of uri as a data URI for an img tag
+func qrDataURI(uri string) (template.URL, error) {
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		return "", err
+	}
+
+	// generated here, not user input
+	return template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png)), nil
+}
+
+// new recovery codes, shown once. Only their hashes are stored.
+func newRecoveryCodes() (codes []string, hashes []string, err error) {
+	for i := 0; i < numRecoveryCodes; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+
+		code := strings.ToLower(base32NoPadding.EncodeToString(b)) // 8 characters
+		code = code[:4] + "-" + code[4:]
+
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+
+	return codes, hashes, nil
+}
+
+// recovery codes are random, a plain hash is enough
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// checks a code from the authenticator app, or else a recovery code which is
+// used up. The user is saved when it changes.
+func (s *Server) checkSecondFactor(user *User, code string) error {
+	if step, ok := verifyTOTP(user.TOTPSecret, code, user.TOTPLastStep, time.Now()); ok {
+		user.TOTPLastStep = step
+		return s.store.UpdateUser(*user)
+	}
+
+	hash := hashRecoveryCode(code)
+	for i, stored := range user.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(stored)) == 1 {
+			user.RecoveryCodes = append(user.RecoveryCodes[:i:i], user.RecoveryCodes[i+1:]...)
+			log.Println("Recovery code used by", user.Username+",", len(user.RecoveryCodes), "left")
+			return s.store.UpdateUser(*user)
+		}
+	}
+
+	return errBadCode
+}
+
+// turns two-factor authentication off
+func (u *User) resetTOTP() {
+	u.TOTPSecret = ""
+	u.TOTPEnabled = false
+	u.TOTPLastStep = 0
+	u.RecoveryCodes = nil
+}
+
+// cookie value remembering whose password was accepted while their code is
+// asked for. It is signed with the session key over a prefixed payload, so
+// neither cookie passes for the other.
+func (s *Server) encodePendingLogin(userID string) string {
+	expires := time.Now().Add(totpLoginTimeout).Unix()
+	payload := base64.RawURLEncoding.EncodeToString([]byte("2fa|" + userID + "|" + strconv.FormatInt(expires, 10)))
+
+	return payload + "." + s.sign(totpCookie+":"+payload)
+}
+
+// ID of the user of a cookie made by encodePendingLogin
+func (s *Server) decodePendingLogin(value string) (string, error) {
+	parts := strings.SplitN(value, ".", 2)
+	if len(parts) != 2 || !hmac.Equal([]byte(s.sign(totpCookie+":"+parts[0])), []byte(parts[1])) {
+		return "", errors.New("bad login signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", err
+	}
+
+	fields := strings.SplitN(string(payload), "|", 3)
+	if len(fields) != 3 || fields[0] != "2fa" {
+		return "", errors.New("bad login payload")
+	}
+
+	expires, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return "", err
+	}
+
+	if time.Now().Unix() > expires {
+		return "", errors.New("login expired")
+	}
+
+	return fields[1], nil
+}
+
+// data of the login code page
+type LoginCodePage struct {
+	Next    string
+	Message string
+}
+
+// second step of a login for users with two-factor authentication
+func (s *Server) LoginCode(w http.ResponseWriter, r *http.Request) {
+	if !ValidMethod(r) {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data := LoginCodePage{Next: localNext(r.FormValue("next"))}
+
+	cookie, err := r.Cookie(totpCookie)
+	if err != nil {
+		http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
+		return
+	}
+
+	userID, err := s.decodePendingLogin(cookie.Value)
+	if err != nil {
+		http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
+		return
+	}
+
+	user, err := s.store.GetUser(userID)
+	if err != nil {
+		http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		templates(r).ExecuteTemplate(w, "admin-login-code.html", data)
+		return
+	}
+
+	addr, name := clientAddr(r), "user:"+user.Username
+	if s.logins.locked(addr) || s.logins.locked(name) {
+		w.WriteHeader(http.StatusUnauthorized)
+		data.Message = errLockedLogin.Error()
+		templates(r).ExecuteTemplate(w, "admin-login-code.html", data)
+		return
+	}
+
+	if err := s.checkSecondFactor(&user, r.FormValue("code")); err != nil {
+		if err != errBadCode {
+			http.Error(w, "Checking code: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		data.Message = err.Error()
+		lockedAddr, lockedName := s.logins.fail(addr), s.logins.fail(name)
+		if lockedAddr || lockedName {
+			log.Println("Login locked for", addr, name)
+			data.Message = errLockedLogin.Error()
+		}
+
+		w.WriteHeader(http.StatusUnauthorized)
+		templates(r).ExecuteTemplate(w, "admin-login-code.html", data)
+		return
+	}
+
+	s.logins.succeed(addr)
+	s.logins.succeed(name)
+
+	http.SetCookie(w, &http.Cookie{Name: totpCookie, Value: "", Path: "/admin/login", MaxAge: -1, HttpOnly: true, Secure: isHTTPS(r), SameSite: http.SameSiteLaxMode})
+
+	if data.Next == "" {
+		data.Next = landingPage(user)
+	}
+
+	s.startSession(w, r, user)
+	http.Redirect(w, r, data.Next, http.StatusSeeOther)
+}
+
+// data of the two-factor settings page
+type TwoFactorPage struct {
+	User          User
+	Secret        string       // while enrolling
+	URI           template.URL // otpauth scheme, which templates would filter
+	QRCode        template.URL
+	RecoveryCodes []string // just generated, shown once
+	Message       string
+}
+
+// lets a user turn two-factor authentication on and off and renew their
+// recovery codes
+func (s *Server) TwoFactor(w http.ResponseWriter, r *http.Request) {
+	if !ValidMethod(r) {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := currentUser(r)
+	data := TwoFactorPage{User: user}
+
+	if r.Method == http.MethodPost {
+		var err error
+
+		switch r.FormValue("action") {
+		case "enroll":
+			err = s.startEnrollment(&user)
+		case "confirm":
+			data.RecoveryCodes, err = s.confirmEnrollment(&user, r.FormValue("code"))
+		case "recovery-codes":
+			data.RecoveryCodes, err = s.renewRecoveryCodes(&user, r.FormValue("code"))
+		case "disable":
+			err = s.disableTOTP(&user, r.FormValue("password"), r.FormValue("code"))
+		default:
+			err = errors.New("unknown action")
+		}
+
+		if err != nil {
+			data.Message = err.Error()
+		}
+		data.User = user
+	}
+
+	// enrolling: show the key until a code confirms it
+	if user.TOTPSecret != "" && !user.TOTPEnabled {
+		data.Secret = user.TOTPSecret
+		data.URI = template.URL(totpURI(user.Username, user.TOTPSecret))
+
+		qr, err := qrDataURI(string(data.URI))
+		if err != nil {
+			log.Println("QR code:", err)
+		}
+		data.QRCode = qr
+	}
+
+	templates(r).ExecuteTemplate(w, "admin-2fa.html", data)
+}
+
+// gives the user a new secret, not used for logins until confirmed
+func (s *Server) startEnrollment(user *User) error {
+	if user.TOTPEnabled {
+		return errors.New("two-factor authentication is already on")
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		return err
+	}
+
+	user.TOTPSecret, user.TOTPLastStep = secret, 0
+	return s.store.UpdateUser(*user)
+}
+
+// turns two-factor authentication on once the app shows the right code
+func (s *Server) confirmEnrollment(user *User, code string) ([]string, error) {
+	if user.TOTPEnabled || user.TOTPSecret == "" {
+		return nil, errors.New("start the setup first")
+	}
+
+	step, ok := verifyTOTP(user.TOTPSecret, code, 0, time.Now())
+	if !ok {
+		return nil, errBadCode
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	user.TOTPEnabled, user.TOTPLastStep, user.RecoveryCodes = true, step, hashes
+	if err := s.store.UpdateUser(*user); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// replaces the recovery codes, the old ones stop working
+func (s *Server) renewRecoveryCodes(user *User, code string) ([]string, error) {
+	if !user.TOTPEnabled {
+		return nil, errors.New("two-factor authentication is off")
+	}
+
+	step, ok := verifyTOTP(user.TOTPSecret, code, user.TOTPLastStep, time.Now())
+	if !ok {
+		return nil, errBadCode
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	user.TOTPLastStep, user.RecoveryCodes = step, hashes
+	if err := s.store.UpdateUser(*user); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// turns two-factor authentication off, asking for both factors so a stolen
+// session cannot do it
+func (s *Server) disableTOTP(user *User, password, code string) error {
+	if !user.TOTPEnabled {
+		return errors.New("two-factor authentication is off")
+	}
+
+	if _, err := s.authenticate(user.Username, password); err != nil {
+		return errBadLogin
+	}
+
+	if err := s.checkSecondFactor(user, code); err != nil {
+		return err
+	}
+
+	user.resetTOTP()
+	return s.store.UpdateUser(*user)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// secret of the RFC 6238 SHA-1 test vectors, "12345678901234567890"
+var rfcSecret = base32NoPadding.EncodeToString([]byte("12345678901234567890"))
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B, the last 6 of its 8 digits
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, test := range tests {
+		code, err := totpCode(rfcSecret, test.unix/totpPeriod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != test.code {
+			t.Errorf("at %d: got %s, want %s", test.unix, code, test.code)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	step := now.Unix() / totpPeriod
+
+	tests := []struct {
+		name     string
+		codeStep int64
+		lastStep int64
+		ok       bool
+	}{
+		{"current step", step, 0, true},
+		{"previous step", step - 1, 0, true},
+		{"next step", step + 1, 0, true},
+		{"two steps old", step - 2, 0, false},
+		{"two steps ahead", step + 2, 0, false},
+		{"step used already", step, step, false},
+		{"older than the last used step", step - 1, step, false},
+		{"newer than the last used step", step + 1, step, true},
+	}
+
+	for _, test := range tests {
+		code, err := totpCode(rfcSecret, test.codeStep)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		matched, ok := verifyTOTP(rfcSecret, code, test.lastStep, now)
+		if ok != test.ok {
+			t.Errorf("%s: got %v, want %v", test.name, ok, test.ok)
+		}
+		if ok && matched != test.codeStep {
+			t.Errorf("%s: matched step %d, want %d", test.name, matched, test.codeStep)
+		}
+	}
+
+	// spaces are allowed, other lengths are not
+	if _, ok := verifyTOTP(rfcSecret, "005 924", 0, now); !ok {
+		t.Error("code with a space rejected")
+	}
+	if _, ok := verifyTOTP(rfcSecret, "05924", 0, now); ok {
+		t.Error("short code accepted")
+	}
+}
+
+// user with two-factor authentication on, returns one of its recovery codes
+func enableTestTOTP(t *testing.T, s *Server, username string) (User, string) {
+	t.Helper()
+
+	user, err := s.store.GetUserByName(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user.TOTPSecret, user.TOTPEnabled, user.RecoveryCodes = rfcSecret, true, hashes
+	if err := s.store.UpdateUser(user); err != nil {
+		t.Fatal(err)
+	}
+
+	return user, codes[0]
+}
+
+func TestSecondFactorReplay(t *testing.T) {
+	s := newTestServer(t)
+	user, _ := enableTestTOTP(t, s, "admin")
+
+	code, err := totpCode(rfcSecret, time.Now().Unix()/totpPeriod)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.checkSecondFactor(&user, code); err != nil {
+		t.Fatal("first use: " + err.Error())
+	}
+
+	stored, err := s.store.GetUser(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.TOTPLastStep == 0 {
+		t.Fatal("the used step was not saved")
+	}
+
+	if err := s.checkSecondFactor(&stored, code); err != errBadCode {
+		t.Fatalf("second use: got %v, want %v", err, errBadCode)
+	}
+}
+
+func TestRecoveryCode(t *testing.T) {
+	s := newTestServer(t)
+	user, code := enableTestTOTP(t, s, "admin")
+
+	if err := s.checkSecondFactor(&user, "aaaa-bbbb"); err != errBadCode {
+		t.Fatalf("unknown code: got %v, want %v", err, errBadCode)
+	}
+
+	// typed without the dash and in capitals
+	typed := strings.ToUpper(strings.Replace(code, "-", "", 1))
+	if err := s.checkSecondFactor(&user, typed); err != nil {
+		t.Fatal("first use: " + err.Error())
+	}
+
+	stored, err := s.store.GetUser(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored.RecoveryCodes) != numRecoveryCodes-1 {
+		t.Fatalf("got %d recovery codes left, want %d", len(stored.RecoveryCodes), numRecoveryCodes-1)
+	}
+
+	if err := s.checkSecondFactor(&stored, code); err != errBadCode {
+		t.Fatalf("second use: got %v, want %v", err, errBadCode)
+	}
+}
+
+func TestLoginAsksForCode(t *testing.T) {
+	s := newTestServer(t)
+	c := newTestClient(t, s)
+	enableTestTOTP(t, s, "admin")
+
+	w := c.post("/admin/login", url.Values{"username": {"admin"}, "password": {testPassword}, "next": {"/admin/new"}})
+	assertRedirect(t, w, http.StatusSeeOther, "/admin/login/2fa?next="+url.QueryEscape("/admin/new"))
+	if _, ok := c.cookies[sessionCookie]; ok {
+		t.Fatal("signed in before the code")
+	}
+
+	// the password alone does not open the admin pages
+	assertRedirect(t, c.get("/admin/new"), http.StatusSeeOther, "/admin/login?next="+url.QueryEscape("/admin/new"))
+
+	assertStatus(t, c.get("/admin/login/2fa?next="+url.QueryEscape("/admin/new")), http.StatusOK)
+
+	w = c.post("/admin/login/2fa", url.Values{"code": {"000000"}, "next": {"/admin/new"}})
+	assertStatus(t, w, http.StatusUnauthorized)
+	assertBody(t, w, errBadCode.Error())
+
+	code, err := totpCode(rfcSecret, time.Now().Unix()/totpPeriod)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w = c.post("/admin/login/2fa", url.Values{"code": {code}, "next": {"/admin/new"}})
+	assertRedirect(t, w, http.StatusSeeOther, "/admin/new")
+	assertStatus(t, c.get("/admin/new"), http.StatusOK)
+
+	// without the password first there is nothing to check a code for
+	other := newTestClient(t, s)
+	assertRedirect(t, other.post("/admin/login/2fa", url.Values{"code": {code}}), http.StatusSeeOther, "/admin/login")
+}
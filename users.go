@@ -0,0 +1,443 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// User is an account of the admin pages
+type User struct {
+	DatabaseID   primitive.ObjectID `bson:"_id"`
+	ID           string             `bson:"id"`
+	Username     string             `bson:"username"` // used to log in
+	Name         string             `bson:"name"`     // shown in bylines
+	Bio          string             `bson:"bio"`
+	PasswordHash string             `bson:"password"` // bcrypt
+	Role         string             `bson:"role"`
+	Created      time.Time          `bson:"created"`
+
+	// two-factor authentication, the secret is set while enrolling already
+	TOTPSecret    string   `bson:"totpsecret"` // base32
+	TOTPEnabled   bool     `bson:"totpenabled"`
+	TOTPLastStep  int64    `bson:"totplaststep"`  // of the last accepted code, codes work once
+	RecoveryCodes []string `bson:"recoverycodes"` // sha256 of the unused ones
+
+	// sessions started before the last password or role change carry an
+	// older generation and are refused, see endSessions
+	SessionGeneration int `bson:"sessiongeneration"`
+}
+
+// user roles
+const (
+	RoleOwner     = "owner"     // everything, including accounts
+	RoleEditor    = "editor"    // all posts and comments
+	RoleAuthor    = "author"    // their own posts
+	RoleModerator = "moderator" // comments only
+)
+
+var roles = []string{RoleOwner, RoleEditor, RoleAuthor, RoleModerator}
+
+// permissions given by roles
+const (
+	PermWritePosts = "write-posts" // write posts and edit their own
+	PermAllPosts   = "all-posts"   // edit and delete anyone's posts
+	PermComments   = "comments"    // manage comments
+	PermUsers      = "users"       // manage accounts
+	PermSettings   = "settings"    // change site settings
+)
+
+var rolePermissions = map[string][]string{
+	RoleOwner:     {PermWritePosts, PermAllPosts, PermComments, PermUsers, PermSettings},
+	RoleEditor:    {PermWritePosts, PermAllPosts, PermComments},
+	RoleAuthor:    {PermWritePosts},
+	RoleModerator: {PermComments},
+}
+
+// reports if the role of the user gives perm
+func (u User) Can(perm string) bool {
+	return Found(rolePermissions[u.Role], perm)
+}
+
+// reports if the user may edit, preview or delete post
+func (u User) CanEditPost(post NewPost) bool {
+	return u.Can(PermAllPosts) || (u.Can(PermWritePosts) && post.Author == u.ID)
+}
+
+// name shown for the user
+func (u User) DisplayName() string {
+	if u.Name != "" {
+		return u.Name
+	}
+	return u.Username
+}
+
+// a new account, the password still has to be set
+func newUser(username, role string) User {
+	database_ID := primitive.NewObjectID()
+
+	return User{
+		DatabaseID: database_ID,
+		ID:         database_ID.Hex(),
+		Username:   strings.ToLower(username),
+		Role:       role,
+		Created:    time.Now(),
+	}
+}
+
+// hashes password into the user
+func (u *User) setPassword(password string) error {
+	if len(password) < 8 {
+		return errors.New("password must be at least 8 characters")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	u.PasswordHash = string(hash)
+	u.endSessions()
+	return nil
+}
+
+// logs the user out everywhere, so a new password or a lesser role locks
+// out sessions that were stolen
+func (u *User) endSessions() {
+	u.SessionGeneration++
+}
+
+// compared against when a username does not exist, so a login takes as
+// long whether the username exists or not
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("no such user"), bcrypt.DefaultCost)
+
+// finds the user with username and checks their password
+func (s *Server) authenticate(username, password string) (User, error) {
+	user, err := s.store.GetUserByName(strings.ToLower(username))
+	if err != nil && err != ErrNotFound {
+		return User{}, err
+	}
+
+	if err == ErrNotFound {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return User{}, errBadLogin
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+		return User{}, errBadLogin
+	}
+
+	return user, nil
+}
+
+type userContextKey struct{}
+
+// signed-in user of a request that went through requireSession
+func currentUser(r *http.Request) User {
+	user, _ := r.Context().Value(userContextKey{}).(User)
+	return user
+}
+
+func withUser(r *http.Request, user User) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), userContextKey{}, user))
+}
+
+// lets only users whose role gives perm through
+func (s *Server) allow(perm string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !currentUser(r).Can(perm) {
+			forbidden(w)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func forbidden(w http.ResponseWriter) {
+	http.Error(w, "You are not allowed to do that", http.StatusForbidden)
+}
+
+// first admin page of a user after logging in
+func landingPage(user User) string {
+	if user.Can(PermWritePosts) {
+		return "/admin/posts"
+	}
+	return "/admin/comments"
+}
+
+// creates the owner account from the adminPassword hash the first time the
+// store has no accounts. The posts written before accounts existed become
+// the owner's.
+func ensureOwner(store Store) error {
+	users, err := store.GetUsers()
+	if err != nil {
+		return err
+	}
+
+	if len(users) > 0 {
+		return nil
+	}
+
+	hash := os.Getenv("adminPassword")
+	if hash == "" {
+		log.Println("No user accounts yet, create one with: myblog useradd <username> owner")
+		return nil
+	}
+
+	owner := newUser("admin", RoleOwner)
+	owner.Name = "Admin"
+	owner.PasswordHash = hash
+
+	if err := store.InsertUser(owner); err != nil {
+		return err
+	}
+
+	posts, err := store.GetPosts(PostFilter{}, 0, 0)
+	if err != nil {
+		return err
+	}
+
+	for _, post := range posts {
+		if post.Author != "" {
+			continue
+		}
+
+		post.Author = owner.ID
+		if err := store.UpdatePost(post); err != nil {
+			return err
+		}
+	}
+
+	log.Println(`Created owner account "admin" with the adminPassword password`)
+	return nil
+}
+
+// data of the accounts page
+type UsersPage struct {
+	User    User // signed in
+	Users   []User
+	Roles   []string
+	Message string
+}
+
+// lists the accounts and creates new ones
+func (s *Server) AdminUsers(w http.ResponseWriter, r *http.Request) {
+	if !ValidMethod(r) {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data := UsersPage{User: currentUser(r), Roles: roles}
+
+	if r.Method == http.MethodPost {
+		user, err := s.newUserFromForm(r)
+		if err != nil {
+			data.Message = err.Error()
+		} else {
+			data.Message = "Account " + user.Username + " created"
+		}
+	}
+
+	users, err := s.store.GetUsers()
+	if err != nil {
+		http.Error(w, "Finding users: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data.Users = users
+
+	templates(r).ExecuteTemplate(w, "admin-users.html", data)
+}
+
+var usernameExp = regexp.MustCompile(`^[a-z0-9_.-]{2,30}$`)
+
+// validates the new account form and stores the account
+func (s *Server) newUserFromForm(r *http.Request) (User, error) {
+	username := strings.ToLower(strings.TrimSpace(r.FormValue("username")))
+	if !usernameExp.MatchString(username) {
+		return User{}, errors.New("usernames are 2 to 30 letters, digits, _ . or -")
+	}
+
+	role := r.FormValue("role")
+	if !Found(roles, role) {
+		return User{}, errors.New("unknown role " + role)
+	}
+
+	if _, err := s.store.GetUserByName(username); err != ErrNotFound {
+		if err != nil {
+			return User{}, err
+		}
+		return User{}, errors.New("username " + username + " is taken")
+	}
+
+	user := newUser(username, role)
+	user.Name = strings.TrimSpace(r.FormValue("name"))
+
+	if err := user.setPassword(r.FormValue("password")); err != nil {
+		return User{}, err
+	}
+
+	return user, s.store.InsertUser(user)
+}
+
+// data of the account page
+type UserPage struct {
+	User    User // signed in
+	Account User // shown
+	Roles   []string
+	Message string
+}
+
+// edits an account: owners edit anyone, other users their own profile
+func (s *Server) AdminUser(w http.ResponseWriter, r *http.Request) {
+	if !ValidMethod(r) {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := currentUser(r)
+	id := r.URL.Path[len("/admin/users/"):]
+
+	if id != user.ID && !user.Can(PermUsers) {
+		forbidden(w)
+		return
+	}
+
+	account, err := s.store.GetUser(id)
+	if err != nil {
+		if err == ErrNotFound {
+			templates(r).ExecuteTemplate(w, "page-end.html", nil)
+			return
+		}
+
+		http.Error(w, "Something went wrong: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := UserPage{User: user, Account: account, Roles: roles}
+
+	if r.Method == http.MethodPost {
+		if r.FormValue("delete") != "" {
+			if err := s.deleteUser(user, account); err != nil {
+				data.Message = err.Error()
+				templates(r).ExecuteTemplate(w, "admin-user.html", data)
+				return
+			}
+
+			http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+			return
+		}
+
+		if err := s.updateUserFromForm(r, user, &account); err != nil {
+			data.Message = err.Error()
+		} else {
+			data.Account, data.Message = account, "Account saved"
+
+			// changing your own password ends your other sessions, not this one
+			if account.ID == user.ID && account.SessionGeneration != user.SessionGeneration {
+				s.startSession(w, r, account)
+			}
+		}
+	}
+
+	templates(r).ExecuteTemplate(w, "admin-user.html", data)
+}
+
+// applies the account form to account, only owners change roles
+func (s *Server) updateUserFromForm(r *http.Request, editor User, account *User) error {
+	edited := *account
+	edited.Name = strings.TrimSpace(r.FormValue("name"))
+	edited.Bio = strings.TrimSpace(r.FormValue("bio"))
+
+	if role := r.FormValue("role"); role != "" && role != account.Role {
+		if !editor.Can(PermUsers) {
+			return errors.New("only owners change roles")
+		}
+
+		if !Found(roles, role) {
+			return errors.New("unknown role " + role)
+		}
+
+		if account.Role == RoleOwner {
+			if err := s.keepAnOwner(account.ID); err != nil {
+				return err
+			}
+		}
+
+		edited.Role = role
+		edited.endSessions()
+	}
+
+	if password := r.FormValue("password"); password != "" {
+		// a stolen session must not be enough to take over the account,
+		// owners resetting someone else's password are trusted
+		if editor.ID == account.ID {
+			if err := bcrypt.CompareHashAndPassword([]byte(account.PasswordHash), []byte(r.FormValue("current_password"))); err != nil {
+				return errors.New("current password is wrong")
+			}
+		}
+
+		if err := edited.setPassword(password); err != nil {
+			return err
+		}
+	}
+
+	if err := s.store.UpdateUser(edited); err != nil {
+		return err
+	}
+
+	*account = edited
+	return nil
+}
+
+// deletes account unless it still has posts or is the last owner
+func (s *Server) deleteUser(editor, account User) error {
+	if !editor.Can(PermUsers) {
+		return errors.New("only owners delete accounts")
+	}
+
+	if editor.ID == account.ID {
+		return errors.New("you cannot delete your own account")
+	}
+
+	posts, err := s.store.GetPosts(PostFilter{Author: account.ID}, 0, 1)
+	if err != nil {
+		return err
+	}
+
+	if len(posts) > 0 {
+		return errors.New(account.Username + " still has posts, delete them or change the role instead")
+	}
+
+	if account.Role == RoleOwner {
+		if err := s.keepAnOwner(account.ID); err != nil {
+			return err
+		}
+	}
+
+	return s.store.DeleteUser(account.ID)
+}
+
+// fails if the account with ID is the only owner
+func (s *Server) keepAnOwner(ID string) error {
+	users, err := s.store.GetUsers()
+	if err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		if user.Role == RoleOwner && user.ID != ID {
+			return nil
+		}
+	}
+
+	return errors.New("the blog needs at least one owner")
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// adds an account with testPassword and returns it
+func addTestUser(t *testing.T, s *Server, username, role string) User {
+	t.Helper()
+
+	user := newUser(username, role)
+	if err := user.setPassword(testPassword); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.store.InsertUser(user); err != nil {
+		t.Fatal(err)
+	}
+
+	return user
+}
+
+// signs c in as username with testPassword
+func (c *testClient) loginAs(username string) {
+	c.t.Helper()
+
+	w := c.post("/admin/login", url.Values{"username": {username}, "password": {testPassword}})
+	if w.Code != http.StatusSeeOther {
+		c.t.Fatalf("login of %s: got status %d", username, w.Code)
+	}
+}
+
+// another browser with the same cookies, e.g. stolen ones
+func (c *testClient) copy() *testClient {
+	copied := newTestClient(c.t, c.s)
+	for name, cookie := range c.cookies {
+		copied.cookies[name] = cookie
+	}
+	return copied
+}
+
+func TestPasswordResetEndsSessions(t *testing.T) {
+	s := newTestServer(t)
+	writer := addTestUser(t, s, "writer", RoleAuthor)
+
+	victim := newTestClient(t, s)
+	victim.loginAs("writer")
+	thief := victim.copy()
+	assertStatus(t, thief.get("/admin/posts"), http.StatusOK)
+
+	owner := newTestClient(t, s)
+	owner.login()
+	w := owner.post("/admin/users/"+writer.ID, url.Values{"role": {RoleAuthor}, "password": {"a new password"}})
+	assertStatus(t, w, http.StatusOK)
+	assertBody(t, w, "Account saved")
+
+	assertRedirect(t, thief.get("/admin/posts"), http.StatusSeeOther, "/admin/login?next="+url.QueryEscape("/admin/posts"))
+
+	// the owner was not logged out by changing someone else's password
+	assertStatus(t, owner.get("/admin/posts"), http.StatusOK)
+
+	// the new password starts new sessions
+	w = victim.post("/admin/login", url.Values{"username": {"writer"}, "password": {"a new password"}})
+	assertRedirect(t, w, http.StatusSeeOther, "/admin/posts")
+	assertStatus(t, victim.get("/admin/posts"), http.StatusOK)
+}
+
+func TestOwnPasswordChangeKeepsSession(t *testing.T) {
+	s := newTestServer(t)
+	admin, err := s.store.GetUserByName("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	me := newTestClient(t, s)
+	me.login()
+	elsewhere := newTestClient(t, s)
+	elsewhere.login()
+
+	w := me.post("/admin/users/"+admin.ID, url.Values{"current_password": {testPassword}, "password": {"a new password"}})
+	assertStatus(t, w, http.StatusOK)
+	assertBody(t, w, "Account saved")
+
+	assertStatus(t, me.get("/admin/posts"), http.StatusOK)
+	assertRedirect(t, elsewhere.get("/admin/posts"), http.StatusSeeOther, "/admin/login?next="+url.QueryEscape("/admin/posts"))
+}
+
+func TestRoleChangeEndsSessions(t *testing.T) {
+	s := newTestServer(t)
+	editor := addTestUser(t, s, "editor", RoleEditor)
+
+	c := newTestClient(t, s)
+	c.loginAs("editor")
+	assertStatus(t, c.get("/admin/posts"), http.StatusOK)
+
+	owner := newTestClient(t, s)
+	owner.login()
+	assertStatus(t, owner.post("/admin/users/"+editor.ID, url.Values{"role": {RoleModerator}}), http.StatusOK)
+
+	assertRedirect(t, c.get("/admin/comments"), http.StatusSeeOther, "/admin/login?next="+url.QueryEscape("/admin/comments"))
+
+	// saving the profile without changes keeps sessions
+	c.loginAs("editor")
+	assertStatus(t, owner.post("/admin/users/"+editor.ID, url.Values{"role": {RoleModerator}, "name": {"Ed"}}), http.StatusOK)
+	assertStatus(t, c.get("/admin/comments"), http.StatusOK)
+}